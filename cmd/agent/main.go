@@ -1,16 +1,56 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"github.com/CvitoyBamp/metricsexporter/internal/agent"
+	"github.com/CvitoyBamp/metricsexporter/internal/crypt"
+	"github.com/CvitoyBamp/metricsexporter/internal/metrics"
+	"github.com/CvitoyBamp/metricsexporter/internal/outbox"
+	"github.com/CvitoyBamp/metricsexporter/internal/retry"
+	"github.com/CvitoyBamp/metricsexporter/internal/tlsutil"
 	"github.com/caarlos0/env/v6"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Config struct {
 	Address        string `env:"ADDRESS"`
 	ReportInterval int    `env:"REPORT_INTERVAL"`
 	PollInterval   int    `env:"POLL_INTERVAL"`
+	Instance       string `env:"AGENT_INSTANCE"`
+	Key            string `env:"KEY"`
+	CryptoKey      string `env:"CRYPTO_KEY"`
+	HTTPS          bool   `env:"HTTPS"`
+	TLSCA          string `env:"TLS_CA"`
+	TLSCert        string `env:"TLS_CERT"`
+	TLSKey         string `env:"TLS_KEY"`
+	GRPCAddress    string `env:"GRPC_ADDRESS"`
+	RateLimit      int    `env:"RATE_LIMIT"`
+	Mode           string `env:"REPORT_MODE"`
+	BatchSize      int    `env:"BATCH_SIZE"`
+	Collectors     string `env:"COLLECTORS"`
+	RuntimeMode    string `env:"RUNTIME_MODE"`
+	RuntimeMetrics string `env:"RUNTIME_METRICS"`
+	HostPoll       int    `env:"HOST_POLL_INTERVAL"`
+	ProcPath       string `env:"PROC_PATH"`
+
+	RetryAttempts  int           `env:"RETRY_ATTEMPTS"`
+	RetryBaseDelay time.Duration `env:"RETRY_BASE_DELAY"`
+	RetryMaxDelay  time.Duration `env:"RETRY_MAX_DELAY"`
+
+	OutboxDir         string        `env:"OUTBOX_DIR"`
+	OutboxSegmentSize int64         `env:"OUTBOX_SEGMENT_SIZE"`
+	OutboxMaxSize     int64         `env:"OUTBOX_MAX_SIZE"`
+	OutboxMaxAge      time.Duration `env:"OUTBOX_MAX_AGE"`
+
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
 }
 
 func main() {
@@ -23,6 +63,54 @@ func main() {
 		"An interval for sending metrics to server")
 	flag.StringVar(&cfg.Address, "a", "localhost:8080",
 		"An address the server will send metrics")
+	flag.StringVar(&cfg.Instance, "i", defaultInstance(),
+		"An instance name sent as the instance label with every metric, hostname by default")
+	flag.StringVar(&cfg.Key, "k", "",
+		"A key for HMAC-SHA256 signing of request bodies, empty disables signing")
+	flag.StringVar(&cfg.CryptoKey, "crypto-key", "",
+		"A path to the server RSA public key for encrypting request bodies")
+	flag.BoolVar(&cfg.HTTPS, "https", false,
+		"Send metrics over HTTPS, enabled implicitly by any of the TLS options")
+	flag.StringVar(&cfg.TLSCA, "tls-ca", "",
+		"A path to the CA bundle for verifying the server certificate")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "",
+		"A path to the client TLS certificate for mutual TLS")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "",
+		"A path to the client TLS private key for mutual TLS")
+	flag.StringVar(&cfg.GRPCAddress, "g", "",
+		"An address of the gRPC server, metrics are sent over gRPC instead of HTTP if set")
+	flag.IntVar(&cfg.RateLimit, "l", 1,
+		"Max number of simultaneous requests to the server")
+	flag.StringVar(&cfg.Mode, "mode", "",
+		"A report mode: "+strings.Join(agent.Modes, ", ")+"; batch by default, grpc if the gRPC server address is set")
+	flag.IntVar(&cfg.BatchSize, "batch-size", 512<<10,
+		"Max size of one batch of metrics in bytes of JSON, larger reports are split, 0 disables splitting")
+	flag.StringVar(&cfg.Collectors, "collectors", "runtime,host",
+		"A comma-separated list of enabled collectors: runtime, host")
+	flag.StringVar(&cfg.RuntimeMode, "runtime-mode", "memstats",
+		"A source of the runtime collector: memstats for the runtime.MemStats metrics or metrics for runtime/metrics")
+	flag.StringVar(&cfg.RuntimeMetrics, "runtime-metrics", "",
+		"A comma-separated list of runtime/metrics names to collect, all for every metric, a default set if empty")
+	flag.IntVar(&cfg.HostPoll, "host-poll-interval", 5,
+		"An interval for collecting host metrics from procfs, 0 means the poll interval")
+	flag.StringVar(&cfg.ProcPath, "proc-path", metrics.DefaultProcPath,
+		"A path where procfs of the host is mounted")
+	flag.IntVar(&cfg.RetryAttempts, "retry-attempts", retry.DefaultPolicy.MaxAttempts,
+		"Max number of attempts to send a report")
+	flag.DurationVar(&cfg.RetryBaseDelay, "retry-base-delay", retry.DefaultPolicy.BaseDelay,
+		"A base delay between attempts, doubled on every attempt with full jitter")
+	flag.DurationVar(&cfg.RetryMaxDelay, "retry-max-delay", retry.DefaultPolicy.MaxDelay,
+		"Max delay between attempts, a longer Retry-After from the server stops retries and postpones reports until then")
+	flag.StringVar(&cfg.OutboxDir, "outbox-dir", "",
+		"A directory for spooling reports the server didn't accept, empty disables the outbox")
+	flag.Int64Var(&cfg.OutboxSegmentSize, "outbox-segment-size", 1<<20,
+		"Max size of one outbox segment file in bytes")
+	flag.Int64Var(&cfg.OutboxMaxSize, "outbox-max-size", 64<<20,
+		"Max total size of the outbox in bytes, the oldest segments are dropped above it, 0 is unlimited")
+	flag.DurationVar(&cfg.OutboxMaxAge, "outbox-max-age", 24*time.Hour,
+		"How long an outbox segment is kept after the last write, 0 is unlimited")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 5*time.Second,
+		"How long to wait for the final report on shutdown")
 	flag.Parse()
 
 	err := env.Parse(&cfg)
@@ -31,6 +119,122 @@ func main() {
 	}
 	flag.Parse()
 
-	c := agent.CreateAgent(cfg.Address)
-	c.RunAgent(cfg.PollInterval, cfg.ReportInterval)
+	if err = validateMode(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	c := agent.CreateAgent(cfg.Address, cfg.Instance)
+	c.Mode = cfg.Mode
+	c.MaxBatchSize = cfg.BatchSize
+	c.Key = cfg.Key
+	c.ShutdownTimeout = cfg.ShutdownTimeout
+	c.RateLimit = cfg.RateLimit
+	c.Retry.MaxAttempts = cfg.RetryAttempts
+	c.Retry.BaseDelay = cfg.RetryBaseDelay
+	c.Retry.MaxDelay = cfg.RetryMaxDelay
+	c.Collectors = agent.CreateCollectorRegistry()
+	for _, name := range splitList(cfg.Collectors) {
+		collector, errCollector := newCollector(name, cfg)
+		if errCollector != nil {
+			log.Fatal(errCollector)
+		}
+		if err = c.Collectors.Register(collector); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.OutboxDir != "" {
+		c.Outbox, err = outbox.CreateOutbox(cfg.OutboxDir, outbox.Options{
+			SegmentSize: cfg.OutboxSegmentSize,
+			MaxSize:     cfg.OutboxMaxSize,
+			MaxAge:      cfg.OutboxMaxAge,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var tlsConfig *tls.Config
+	if cfg.HTTPS || cfg.TLSCA != "" || cfg.TLSCert != "" || cfg.TLSKey != "" {
+		tlsConfig, err = tlsutil.ClientConfig(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.EnableTLS(tlsConfig)
+	}
+	if cfg.CryptoKey != "" {
+		c.PublicKey, err = crypt.LoadPublicKey(cfg.CryptoKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.GRPCAddress != "" {
+		if err = c.DialGRPC(cfg.GRPCAddress, tlsConfig); err != nil {
+			log.Fatal(err)
+		}
+		defer c.CloseGRPC()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	if err = c.RunAgent(ctx, cfg.PollInterval, cfg.ReportInterval); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// validateMode Проверяет способ отправки отчётов: grpc требует адрес gRPC-сервера, остальные способы - его отсутствия
+func validateMode(cfg Config) error {
+	if cfg.Mode == "" {
+		return nil
+	}
+	if err := agent.ValidateMode(cfg.Mode); err != nil {
+		return err
+	}
+	if cfg.Mode == agent.ModeGRPC && cfg.GRPCAddress == "" {
+		return fmt.Errorf("report mode %s needs the gRPC server address", cfg.Mode)
+	}
+	if cfg.Mode != agent.ModeGRPC && cfg.GRPCAddress != "" {
+		return fmt.Errorf("report mode %s can't be used with the gRPC server address", cfg.Mode)
+	}
+	return nil
+}
+
+// newCollector Создаёт встроенный сборщик метрик по имени
+func newCollector(name string, cfg Config) (metrics.Collector, error) {
+	switch name {
+	case "runtime":
+		interval := time.Duration(cfg.PollInterval) * time.Second
+		switch cfg.RuntimeMode {
+		case "memstats":
+			return metrics.CreateRuntimeCollector(interval), nil
+		case "metrics":
+			return metrics.CreateRuntimeMetricsCollector(interval, splitList(cfg.RuntimeMetrics))
+		default:
+			return nil, fmt.Errorf("unknown runtime mode %q, expected metrics or memstats", cfg.RuntimeMode)
+		}
+	case "host":
+		return metrics.CreateHostCollector(cfg.ProcPath, time.Duration(cfg.HostPoll)*time.Second), nil
+	default:
+		return nil, fmt.Errorf("unknown collector %q, expected runtime or host", name)
+	}
+}
+
+// splitList Разбирает список через запятую, пропуская пустые элементы
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// defaultInstance Имя экземпляра агента по умолчанию - имя хоста
+func defaultInstance() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("can't get hostname, instance label won't be set: %s", err)
+		return ""
+	}
+	return hostname
 }
@@ -83,3 +83,57 @@ func Test_main(t *testing.T) {
 		})
 	}
 }
+
+func Test_newCollector(t *testing.T) {
+	tests := []struct {
+		testName string
+		name     string
+		cfg      Config
+		wantErr  bool
+	}{
+		{testName: "Runtime metrics collector", name: "runtime", cfg: Config{RuntimeMode: "metrics", RuntimeMetrics: "/sched/goroutines:goroutines"}},
+		{testName: "MemStats compatibility mode", name: "runtime", cfg: Config{RuntimeMode: "memstats"}},
+		{testName: "Unknown runtime mode", name: "runtime", cfg: Config{RuntimeMode: "unknown"}, wantErr: true},
+		{testName: "Unknown runtime metric", name: "runtime", cfg: Config{RuntimeMode: "metrics", RuntimeMetrics: "/unknown:metric"}, wantErr: true},
+		{testName: "Host collector", name: "host", cfg: Config{ProcPath: metrics.DefaultProcPath}},
+		{testName: "Unknown collector", name: "unknown", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			c, err := newCollector(tt.name, tt.cfg)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.name, c.Name())
+		})
+	}
+}
+
+func Test_validateMode(t *testing.T) {
+	tests := []struct {
+		testName string
+		cfg      Config
+		wantErr  bool
+	}{
+		{testName: "Default mode", cfg: Config{}},
+		{testName: "Batch mode", cfg: Config{Mode: agent.ModeBatch}},
+		{testName: "gRPC mode", cfg: Config{Mode: agent.ModeGRPC, GRPCAddress: "localhost:3200"}},
+		{testName: "gRPC mode without address", cfg: Config{Mode: agent.ModeGRPC}, wantErr: true},
+		{testName: "HTTP mode with gRPC address", cfg: Config{Mode: agent.ModeJSON, GRPCAddress: "localhost:3200"}, wantErr: true},
+		{testName: "Unknown mode", cfg: Config{Mode: "udp"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			err := validateMode(tt.cfg)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"github.com/CvitoyBamp/metricsexporter/internal/crypt"
+	"log"
+	"os"
+)
+
+// keygen Создаёт пару ключей RSA: закрытый передаётся серверу, открытый - агентам через -crypto-key
+func main() {
+	bits := flag.Int("bits", 4096, "Size of the RSA key in bits")
+	privPath := flag.String("private", "private.pem", "A path to save the private key for the server")
+	pubPath := flag.String("public", "public.pem", "A path to save the public key for agents")
+	flag.Parse()
+
+	privPEM, pubPEM, err := crypt.GenerateKeys(*bits)
+	if err != nil {
+		log.Fatalf("Can't generate keys, err: %s", err)
+	}
+
+	if err = os.WriteFile(*privPath, privPEM, 0o600); err != nil {
+		log.Fatalf("Can't save private key, err: %s", err)
+	}
+	if err = os.WriteFile(*pubPath, pubPEM, 0o644); err != nil {
+		log.Fatalf("Can't save public key, err: %s", err)
+	}
+
+	log.Printf("Keys were saved to %s and %s", *privPath, *pubPath)
+}
@@ -1,24 +1,42 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/crypt"
+	"github.com/CvitoyBamp/metricsexporter/internal/db"
+	"github.com/CvitoyBamp/metricsexporter/internal/filestorage"
 	"github.com/CvitoyBamp/metricsexporter/internal/handlers"
+	"github.com/CvitoyBamp/metricsexporter/internal/middlewares"
+	"github.com/CvitoyBamp/metricsexporter/internal/rpc"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"github.com/CvitoyBamp/metricsexporter/internal/subnet"
+	"github.com/CvitoyBamp/metricsexporter/internal/tlsutil"
 	"github.com/caarlos0/env/v6"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"log"
-)
-
-const (
-	user = "postgres"
-	pass = "khjw7o9aJmCMVYJJ"
-	url  = "db.zjqldcixgspktmukawkk.supabase.co"
-	port = "5432"
-	db   = "postgres"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	var cfg handlers.Config
 
+	// Подкоманда `server migrate` только применяет миграции схемы БД и завершается
+	args := os.Args[1:]
+	migrate := len(args) > 0 && args[0] == "migrate"
+	if migrate {
+		args = args[1:]
+	}
+
 	flag.StringVar(&cfg.Address, "a", "localhost:8080",
 		"An address the server run")
 	flag.IntVar(&cfg.StoreInterval, "i", 300,
@@ -27,21 +45,203 @@ func main() {
 		"A path to save file with metrics")
 	flag.BoolVar(&cfg.Restore, "r", true,
 		"Boolean flag to load file with metrics")
+	flag.StringVar(&cfg.RestorePolicy, "restore-policy", "",
+		"Restore policy on start: keep, reset or file (by default keep if -r is set, otherwise reset; "+
+			"with -d the database is kept and reset only with -restore-policy=reset)")
 	flag.StringVar(&cfg.DSN, "d", "",
 		"Database DSN")
-	flag.Parse()
-
-	//fmt.Sprintf("postgres://%s:%s@%s:%s/%s", user, pass, url, port, db)
+	flag.IntVar(&cfg.DBMaxConns, "db-max-conns", 10,
+		"Max size of the database connection pool")
+	flag.IntVar(&cfg.HistorySize, "history-size", storage.DefaultHistorySize,
+		"Number of samples kept per metric by the in-memory storage")
+	flag.DurationVar(&cfg.RetentionRaw, "retention-raw", 6*time.Hour,
+		"How long raw samples of metrics history are kept before rolling up to 1-minute aggregates")
+	flag.DurationVar(&cfg.RetentionMinute, "retention-minute", 7*24*time.Hour,
+		"How long 1-minute aggregates are kept before rolling up to hourly aggregates")
+	flag.DurationVar(&cfg.RetentionHourly, "retention-hourly", 0,
+		"How long hourly aggregates are kept, 0 keeps them forever")
+	flag.DurationVar(&cfg.CompactInterval, "compact-interval", time.Minute,
+		"An interval for applying retention to metrics history, 0 disables it")
+	flag.StringVar(&cfg.Key, "k", "",
+		"A key for HMAC-SHA256 signing of requests and responses, empty disables signing")
+	flag.StringVar(&cfg.CryptoKey, "crypto-key", "",
+		"A path to the RSA private key for decrypting agent requests")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "",
+		"A path to the TLS certificate of the server, enables HTTPS together with -tls-key")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "",
+		"A path to the TLS private key of the server")
+	flag.StringVar(&cfg.TLSClientCA, "tls-client-ca", "",
+		"A path to the CA bundle for verifying client certificates, enables mutual TLS")
+	flag.StringVar(&cfg.TrustedSubnet, "t", "",
+		"A trusted subnet in CIDR notation, metrics are accepted only from X-Real-IP within it")
+	flag.StringVar(&cfg.GRPCAddress, "g", "",
+		"An address the gRPC server run, empty disables gRPC")
+	flag.Int64Var(&cfg.MaxBodySize, "max-body-size", middlewares.DefaultMaxBodySize,
+		"Max size of a request body in bytes, both as received and after decompression")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 10*time.Second,
+		"How long to wait for in-flight requests and the final flush on shutdown")
+	flag.CommandLine.Parse(args)
 
 	err := env.Parse(&cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	server := handlers.CreateServer(cfg)
+	if migrate {
+		runMigrations(cfg)
+		return
+	}
+
+	policy, err := storage.ParseRestorePolicy(cfg.RestorePolicy, cfg.Restore, cfg.DSN != "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.CompactInterval > 0 {
+		if errRetention := cfg.RetentionPolicy().Validate(); errRetention != nil {
+			log.Fatal(errRetention)
+		}
+	}
+
+	trusted, err := subnet.Parse(cfg.TrustedSubnet)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	server := handlers.CreateServer(cfg, newRepository(ctx, cfg, policy))
+	server.TrustedSubnet = trusted
+
+	if cfg.CryptoKey != "" {
+		server.PrivateKey, err = crypt.LoadPrivateKey(cfg.CryptoKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if server.Compactor != nil {
+		go server.Compactor.Run(ctx)
+	}
+
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddress != "" {
+		grpcServer = runGRPCServer(cfg, server)
+	}
+
+	errServer := make(chan error, 1)
+	go func() {
+		errServer <- server.RunServer()
+	}()
+
+	select {
+	case err = <-errServer:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	case <-ctx.Done():
+		log.Print("Shutting down the server")
+	}
+
+	shutdownServer(server, grpcServer, cfg.ShutdownTimeout)
+}
+
+// shutdownServer Останавливает gRPC и HTTP, дожидаясь обрабатываемых запросов не дольше timeout, и сохраняет метрики
+func shutdownServer(server *handlers.CustomServer, grpcServer *grpc.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Server shutdown wasn't clean, err: %s", err)
+		return
+	}
+	log.Print("Server was stopped")
+}
+
+// runGRPCServer Запускает gRPC-сервис метрик рядом с HTTP поверх того же хранилища и с теми же ключом, подсетью и TLS
+func runGRPCServer(cfg handlers.Config, server *handlers.CustomServer) *grpc.Server {
+	opts := rpc.Options{
+		Key:           cfg.Key,
+		TrustedSubnet: server.TrustedSubnet,
+	}
+
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		tlsConfig, err := tlsutil.ServerConfig(cfg.TLSClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			log.Fatalf("Can't load TLS certificate of the server, err: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		opts.Credentials = credentials.NewTLS(tlsConfig)
+	}
+
+	listener, err := net.Listen("tcp", cfg.GRPCAddress)
+	if err != nil {
+		log.Fatalf("Can't listen gRPC address %s, err: %s", cfg.GRPCAddress, err)
+	}
+
+	grpcServer := rpc.CreateServer(server.Storage, server.Agents, opts)
+	go func() {
+		log.Printf("gRPC server is listening on %s", cfg.GRPCAddress)
+		if errServe := grpcServer.Serve(listener); errServe != nil {
+			log.Fatal(errServe)
+		}
+	}()
+	return grpcServer
+}
+
+func runMigrations(cfg handlers.Config) {
+	if cfg.DSN == "" {
+		log.Fatal("Database DSN is required to run migrations")
+	}
+
+	database := db.ConnectDB(cfg.DSN, int32(cfg.DBMaxConns))
+	defer database.Close()
+
+	err := database.Migrate(context.Background())
+	if err != nil {
+		log.Fatalf("Can't migrate database schema, err: %s", err)
+	}
+
+	log.Print("Database schema is up to date")
+}
+
+// newRepository Выбирает хранилище метрик один раз при старте сервера и применяет к нему политику восстановления
+func newRepository(ctx context.Context, cfg handlers.Config, policy storage.RestorePolicy) storage.Repository {
+	if cfg.DSN != "" {
+		database := db.CreateDB(cfg.DSN, int32(cfg.DBMaxConns))
+		restoreDB(database, cfg.FilePath, policy)
+		return database
+	}
+
+	if cfg.FilePath == "" {
+		if policy == storage.RestoreFile {
+			log.Fatal("File path is required for the file restore policy")
+		}
+		return storage.CreateMemStorageWithHistory(cfg.HistorySize)
+	}
+
+	fs := filestorage.CreateFileStorage(cfg.FilePath, cfg.StoreInterval, cfg.HistorySize)
 
-	if cfg.Restore && cfg.FilePath != "" && cfg.DSN == "" {
-		errLoad := server.PreloadMetrics()
+	if policy == storage.RestoreKeep || policy == storage.RestoreFile {
+		errLoad := fs.PreloadMetrics()
 		if errLoad != nil {
 			if fmt.Sprintf("%s", errLoad) == "EOF" {
 				log.Printf("Can't read metrics from the file because it doesn't exist.")
@@ -51,12 +251,33 @@ func main() {
 		}
 	}
 
-	if cfg.StoreInterval > 0 && cfg.FilePath != "" && cfg.DSN == "" {
-		go func() {
-			server.PostSaveMetrics()
-		}()
+	if cfg.StoreInterval > 0 {
+		go fs.PostSaveMetrics(ctx)
 	}
 
-	log.Fatal(server.RunServer())
+	return fs
+}
 
+func restoreDB(database *db.Database, filePath string, policy storage.RestorePolicy) {
+	ctx := context.Background()
+
+	switch policy {
+	case storage.RestoreReset:
+		if err := database.Reset(ctx); err != nil {
+			log.Fatalf("Can't reset metrics in db, err: %s", err)
+		}
+		log.Print("Metrics in db were reset")
+	case storage.RestoreFile:
+		if filePath == "" {
+			log.Fatal("File path is required for the file restore policy")
+		}
+		snapshot, err := filestorage.LoadSnapshot(filePath)
+		if err != nil {
+			log.Fatalf("Can't read metrics snapshot from file, err: %s", err)
+		}
+		if err = database.ReplaceMetrics(ctx, snapshot); err != nil {
+			log.Fatalf("Can't restore metrics in db from file, err: %s", err)
+		}
+		log.Printf("Restored %d metrics in db from %s", len(snapshot), filePath)
+	}
 }
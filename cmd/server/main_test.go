@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
+	"github.com/CvitoyBamp/metricsexporter/internal/filestorage"
 	"github.com/CvitoyBamp/metricsexporter/internal/handlers"
 	"github.com/CvitoyBamp/metricsexporter/internal/storage"
 	"github.com/stretchr/testify/require"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -147,3 +151,23 @@ func TestMetricCreatorHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestShutdownServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics-db.json")
+	fs := filestorage.CreateFileStorage(path, 300, 0)
+	require.NoError(t, fs.SetMetric(context.Background(), "gauge", "testGauge", nil, "1.5"))
+
+	server := handlers.CreateServer(handlers.Config{Address: "127.0.0.1:0"}, fs)
+	errServer := make(chan error, 1)
+	go func() {
+		errServer <- server.RunServer()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	shutdownServer(server, nil, time.Second)
+	assert.ErrorIs(t, <-errServer, http.ErrServerClosed)
+
+	snapshot, err := filestorage.LoadSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Metric{{MType: "gauge", ID: "testGauge", Value: "1.5"}}, snapshot)
+}
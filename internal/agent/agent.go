@@ -2,40 +2,173 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
 	"fmt"
-	"github.com/CvitoyBamp/metricsexporter/internal/db"
+	"github.com/CvitoyBamp/metricsexporter/internal/crypt"
 	"github.com/CvitoyBamp/metricsexporter/internal/json"
 	"github.com/CvitoyBamp/metricsexporter/internal/metrics"
 	"github.com/CvitoyBamp/metricsexporter/internal/middlewares"
+	"github.com/CvitoyBamp/metricsexporter/internal/outbox"
+	pb "github.com/CvitoyBamp/metricsexporter/internal/proto"
+	"github.com/CvitoyBamp/metricsexporter/internal/retry"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"github.com/CvitoyBamp/metricsexporter/internal/subnet"
+	"google.golang.org/grpc"
 	"log"
 	"net/http"
-	"runtime"
+	neturl "net/url"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Agent struct {
 	Client   *http.Client
 	Endpoint string
-	Metrics  *metrics.Metrics
+	Scheme   string // http или https, пустая схема - http
+	Instance string // имя экземпляра агента, отправляется меткой instance с каждой метрикой
+	Key      string // ключ подписи тела запросов HMAC-SHA256, пустой ключ отключает подпись
+	// PublicKey Открытый ключ сервера для шифрования тел запросов, nil - тела не шифруются
+	PublicKey *rsa.PublicKey
+	Metrics   *metrics.Metrics
+	// ShutdownTimeout Сколько ждать финальной отправки метрик при остановке, 0 - отправка без ограничения
+	ShutdownTimeout time.Duration
+	// RateLimit Сколько запросов к серверу агент выполняет одновременно, 0 - один
+	RateLimit int
+	// Collectors Сборщики метрик, по умолчанию только runtime
+	Collectors *CollectorRegistry
+	// Mode Способ отправки отчётов, один из Modes. Пустой - grpc при подключении к gRPC, иначе batch
+	Mode string
+	// MaxBatchSize Предельный размер пачки метрик в байтах JSON, большие снимки делятся на части, 0 - без деления
+	MaxBatchSize int
+	// batchUnsupported Сервер ответил 404 на /updates/, пачки отправляются по одной метрике в JSON
+	batchUnsupported atomic.Bool
+	// Retry Политика повторов отправки отчёта
+	Retry retry.Policy
+	// Outbox Очередь на диске для отчётов, которые не удалось отправить, nil - такие отчёты теряются
+	Outbox *outbox.Outbox
+	// replaying Воспроизведение очереди на диске стоит в очереди отправителей или выполняется
+	replaying atomic.Bool
+	// notBefore Время в наносекундах Unix, до которого сервер через Retry-After просил не присылать отчёты
+	notBefore atomic.Int64
+	// realIP Адрес агента для X-Real-IP при отправке по HTTP
+	realIP outboundIP
+	// GRPCClient Клиент gRPC-сервиса метрик, с ним агент отправляет метрики через gRPC
+	GRPCClient  pb.MetricsClient
+	grpcConn    *grpc.ClientConn
+	grpcAddress string
+	grpcRealIP  outboundIP
 }
 
-func CreateAgent(endpoint string) *Agent {
+// outboundIP Адрес, с которого агент обращается к серверу. Определяется при первом запросе и дальше не меняется,
+// а пока его определить не удалось, попытка повторяется со следующим запросом
+type outboundIP struct {
+	mu sync.Mutex
+	ip string
+}
+
+func (o *outboundIP) get(address string) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.ip == "" {
+		ip, err := subnet.OutboundIP(address)
+		if err != nil {
+			return "", err
+		}
+		o.ip = ip
+	}
+	return o.ip, nil
+}
+
+func CreateAgent(endpoint, instance string) *Agent {
+	collectors := CreateCollectorRegistry()
+	// Реестр пуст, ошибки повторной регистрации быть не может
+	_ = collectors.Register(metrics.CreateRuntimeCollector(0))
+
 	return &Agent{
 		Client: &http.Client{
 			Timeout: 1 * time.Second,
 		},
 		Endpoint: endpoint,
+		Instance: instance,
 		Metrics: &metrics.Metrics{
 			Gauge:   make(map[string]float64),
 			Counter: make(map[string]int64),
 		},
+		Collectors: collectors,
+		Retry:      defaultRetryPolicy(),
 	}
 }
 
+// defaultRetryPolicy Политика повторов по умолчанию с учётом кодов gRPC
+func defaultRetryPolicy() retry.Policy {
+	p := retry.DefaultPolicy
+	p.Retryable = retryable
+	return p
+}
+
+// EnableTLS Переключает агента на HTTPS с заданной конфигурацией TLS
+func (a *Agent) EnableTLS(cfg *tls.Config) {
+	a.Scheme = "https"
+	a.Client.Transport = &http.Transport{TLSClientConfig: cfg}
+}
+
+// url Адрес ручки сервера path
+func (a *Agent) url(path string) string {
+	scheme := a.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + a.Endpoint + path
+}
+
+// labels Метки, которыми агент помечает свои метрики
+func (a *Agent) labels() storage.Labels {
+	if a.Instance == "" {
+		return nil
+	}
+	return storage.Labels{storage.InstanceLabel: a.Instance}
+}
+
+// newRequest Создаёт POST-запрос с телом body, шифрует непустое тело открытым ключом сервера
+// и подписывает то, что уходит в сеть, в заголовке HashSHA256
+func (a *Agent) newRequest(url string, body []byte) (*http.Request, error) {
+	encrypted := false
+	if a.PublicKey != nil && len(body) > 0 {
+		var err error
+		body, err = crypt.Encrypt(a.PublicKey, body)
+		if err != nil {
+			return nil, err
+		}
+		encrypted = true
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		req.Header.Set(crypt.Header, crypt.Scheme)
+	}
+	if realIP, errIP := a.realIP.get(a.Endpoint); errIP == nil {
+		req.Header.Set(subnet.Header, realIP)
+	} else {
+		log.Print(errIP)
+	}
+	if a.Key != "" {
+		req.Header.Set(middlewares.HashHeader, middlewares.Sign(body, a.Key))
+	}
+	return req, nil
+}
+
 func (a *Agent) PostMetricURL(metricType, metricName, metricValue string) error {
-	url := fmt.Sprintf("http://%s/update/%s/%s/%s", a.Endpoint, metricType, metricName, metricValue)
-	req, errReq := http.NewRequest(http.MethodPost, url, nil)
+	url := a.url(fmt.Sprintf("/update/%s/%s/%s", metricType, metricName, metricValue))
+	if a.Instance != "" {
+		url += "?" + storage.LabelQueryPrefix + storage.InstanceLabel + "=" + neturl.QueryEscape(a.Instance)
+	}
+	req, errReq := a.newRequest(url, nil)
 	if errReq != nil {
 		return fmt.Errorf("can't create request, err: %v", errReq)
 	}
@@ -44,12 +177,12 @@ func (a *Agent) PostMetricURL(metricType, metricName, metricValue string) error
 	res, err := a.Client.Do(req)
 	if err != nil {
 		log.Printf("metric %s with value %s was wasn't posted to %s\n", metricName, metricValue, url)
-		return fmt.Errorf("can't POST to URL, err: %v", err)
+		return fmt.Errorf("can't POST to URL, err: %w", err)
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("status code not equal 200: %v", res.StatusCode)
+		return retry.NewStatusError(res)
 	}
 
 	log.Printf("metric %s with value %s was successfully posted to %s\n", metricName, metricValue, url)
@@ -58,7 +191,7 @@ func (a *Agent) PostMetricURL(metricType, metricName, metricValue string) error
 }
 
 func (a *Agent) PostMetricJSON(metricType, metricName, metricValue string) error {
-	data, errJSON := json.Creator(metricValue, metricType, metricName)
+	data, errJSON := json.Creator(metricValue, metricType, metricName, a.labels())
 	if errJSON != nil {
 		log.Printf("can't convert body to json, err: %s", errJSON)
 		return fmt.Errorf("can't convert body to json, err: %s", errJSON)
@@ -70,9 +203,9 @@ func (a *Agent) PostMetricJSON(metricType, metricName, metricValue string) error
 		return fmt.Errorf("can't compress data, err: %s", errComp)
 	}
 
-	url := fmt.Sprintf("http://%s/update/", a.Endpoint)
+	url := a.url("/update/")
 
-	req, errReq := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(compressedData))
+	req, errReq := a.newRequest(url, compressedData)
 	if errReq != nil {
 		log.Printf("can't create request with body, err: %s", errReq)
 		return fmt.Errorf("can't create request with body, err: %s", errReq)
@@ -85,12 +218,12 @@ func (a *Agent) PostMetricJSON(metricType, metricName, metricValue string) error
 	res, err := a.Client.Do(req)
 	if err != nil {
 		log.Printf("metric %s with value %s was wasn't posted to %s\n", metricName, metricValue, url)
-		return fmt.Errorf("can't POST to URL, err: %v", err)
+		return fmt.Errorf("can't POST to URL, err: %w", err)
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("status code not equal 200: %v", res.StatusCode)
+		return retry.NewStatusError(res)
 	}
 
 	log.Printf("metric %s with value %s was successfully posted to %s\n", metricName, metricValue, url)
@@ -98,8 +231,8 @@ func (a *Agent) PostMetricJSON(metricType, metricName, metricValue string) error
 	return nil
 }
 
-func (a *Agent) PostMetricsBatch() error {
-	data, errJSON := json.ListCreator(a.Metrics.Gauge, a.Metrics.Counter)
+func (a *Agent) PostMetricsBatch(s metrics.Snapshot) error {
+	data, errJSON := json.ListCreator(s.Gauge, s.Counter, a.labels())
 	if errJSON != nil {
 		log.Printf("can't convert body to json, err: %s", errJSON)
 		return fmt.Errorf("can't convert body to json, err: %s", errJSON)
@@ -111,9 +244,9 @@ func (a *Agent) PostMetricsBatch() error {
 		return fmt.Errorf("can't compress data, err: %s", errComp)
 	}
 
-	url := fmt.Sprintf("http://%s/updates/", a.Endpoint)
+	url := a.url("/updates/")
 
-	req, errReq := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(compressedData))
+	req, errReq := a.newRequest(url, compressedData)
 	if errReq != nil {
 		log.Printf("can't create request with body, err: %s", errReq)
 		return fmt.Errorf("can't create request with body, err: %s", errReq)
@@ -126,12 +259,12 @@ func (a *Agent) PostMetricsBatch() error {
 	res, err := a.Client.Do(req)
 	if err != nil {
 		log.Printf("can't POST batch of metrics")
-		return fmt.Errorf("can't POST to URL, err: %v", err)
+		return fmt.Errorf("can't POST to URL, err: %w", err)
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("status code not equal 200: %v", res.StatusCode)
+		return retry.NewStatusError(res)
 	}
 
 	log.Printf("Batch of metrics was successfully posted.")
@@ -139,66 +272,200 @@ func (a *Agent) PostMetricsBatch() error {
 	return nil
 }
 
-func (a *Agent) PostMetrics(types string) error {
-	a.Metrics.RLock()
-	defer a.Metrics.RUnlock()
+// job Запрос к серверу и часть снимка метрик, которую он отправляет.
+// batch - пачка, которую при отсутствии /updates/ на сервере можно переотправить по одной метрике,
+// replay - воспроизведение очереди на диске, которое выполняется как есть, без повторов
+type job struct {
+	send     func() error
+	snapshot metrics.Snapshot
+	batch    bool
+	replay   bool
+}
 
-	if types == "batch" {
-		err := a.PostMetricsBatch()
-		if err != nil {
-			return fmt.Errorf("can't POST to URL, err: %v", err)
-		}
+// done Подтверждает приращения счётчиков после успешной отправки или возвращает их для следующего снимка
+func (a *Agent) done(j job, err error) {
+	if err != nil {
+		a.Metrics.Release(j.snapshot.Counter)
+		return
 	}
+	a.Metrics.Ack(j.snapshot.Counter)
+}
 
-	for k, v := range a.Metrics.Gauge {
-		if types == "json" {
-			err := a.PostMetricJSON("gauge", k, strconv.FormatFloat(v, 'f', -1, 64))
-			if err != nil {
-				return fmt.Errorf("can't POST to URL, err: %v", err)
-			}
+// reportJobs Разбивает снимок метрик на запросы к серверу: пачки не больше MaxBatchSize для batch и grpc,
+// по запросу на метрику для json и url. Если сервер не принимает пачки, batch отправляется как json
+func (a *Agent) reportJobs(types string, s metrics.Snapshot) []job {
+	if types == ModeBatch && a.batchUnsupported.Load() {
+		types = ModeJSON
+	}
+
+	switch types {
+	case ModeBatch:
+		var jobs []job
+		for _, chunk := range splitSnapshot(s, a.MaxBatchSize, a.labels()) {
+			chunk := chunk
+			jobs = append(jobs, job{send: func() error { return a.postBatch(chunk) }, snapshot: chunk, batch: true})
 		}
-		if types == "url" {
-			err := a.PostMetricURL("gauge", k, strconv.FormatFloat(v, 'f', -1, 64))
-			if err != nil {
-				return fmt.Errorf("can't POST to URL, err: %v", err)
-			}
+		return jobs
+	case ModeGRPC:
+		var jobs []job
+		for _, chunk := range splitSnapshot(s, a.MaxBatchSize, a.labels()) {
+			chunk := chunk
+			jobs = append(jobs, job{send: func() error { return a.PostMetricsGRPC(chunk) }, snapshot: chunk})
 		}
+		return jobs
 	}
-	for k, v := range a.Metrics.Counter {
-		if types == "json" {
-			err := a.PostMetricJSON("counter", k, strconv.FormatInt(v, 10))
-			if err != nil {
-				return fmt.Errorf("can't POST to URL, err: %v", err)
-			}
-		}
-		if types == "url" {
-			err := a.PostMetricURL("counter", k, strconv.FormatInt(v, 10))
-			if err != nil {
-				return fmt.Errorf("can't POST to URL, err: %v", err)
+
+	post := a.PostMetricURL
+	if types == ModeJSON {
+		post = a.PostMetricJSON
+	}
+
+	jobs := make([]job, 0, len(s.Gauge)+len(s.Counter))
+	for k, v := range s.Gauge {
+		name, value := k, strconv.FormatFloat(v, 'f', -1, 64)
+		jobs = append(jobs, job{
+			send:     func() error { return post("gauge", name, value) },
+			snapshot: metrics.Snapshot{Gauge: map[string]float64{k: v}},
+		})
+	}
+	for k, v := range s.Counter {
+		name, value := k, strconv.FormatInt(v, 10)
+		jobs = append(jobs, job{
+			send:     func() error { return post("counter", name, value) },
+			snapshot: metrics.Snapshot{Counter: map[string]int64{k: v}},
+		})
+	}
+	return jobs
+}
+
+// PostMetrics Последовательно отправляет текущие метрики способом types, одним из Modes.
+// Приращения счётчиков, которые не удалось отправить, остаются для следующей отправки
+func (a *Agent) PostMetrics(types string) error {
+	if err := a.validateMode(types); err != nil {
+		return err
+	}
+
+	jobs := a.reportJobs(types, a.Metrics.Reserve())
+	for i, j := range jobs {
+		if err := a.deliver(j, once); err != nil {
+			for _, rest := range jobs[i+1:] {
+				a.done(rest, err)
 			}
+			return fmt.Errorf("can't POST to URL, err: %w", err)
 		}
 	}
 	return nil
 }
 
-func (a *Agent) RunAgent(pollInterval, reportInterval int) {
+// sender Выполняет запросы из очереди, пока она не закрыта, повторяя их по политике Retry.
+// После отмены ctx каждый оставшийся запрос выполняется один раз
+func (a *Agent) sender(ctx context.Context, jobs <-chan job, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	do := func(send func() error) error { return a.Retry.Do(ctx, send) }
+	for j := range jobs {
+		var err error
+		if j.replay {
+			err = j.send()
+		} else {
+			err = a.deliver(j, do)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// RunAgent Собирает и отправляет метрики, пока не отменён ctx, после чего отправляет их последний раз.
+// Каждый сборщик из Collectors работает в своей горутине, сборщики без интервала опрашиваются раз в pollInterval секунд.
+// Сбор не зависит от отправки: снимки метрик и воспроизведение очереди на диске уходят в очередь,
+// которую разбирают RateLimit отправителей, поэтому одновременно к серверу открыто не больше RateLimit запросов.
+// С неизвестным способом отправки Mode агент не запускается и возвращает ошибку
+func (a *Agent) RunAgent(ctx context.Context, pollInterval, reportInterval int) error {
+	types := a.mode()
+	if err := a.validateMode(types); err != nil {
+		return err
+	}
+
+	workers := a.RateLimit
+	if workers <= 0 {
+		workers = 1
+	}
+	jobs := make(chan job, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go a.sender(ctx, jobs, &wg)
+	}
+
+	if a.Collectors != nil {
+		for _, c := range a.Collectors.List() {
+			go a.runCollector(ctx, c, time.Duration(pollInterval)*time.Second)
+		}
+	}
+
 	rI := time.NewTicker(time.Duration(reportInterval) * time.Second)
-	pI := time.NewTicker(time.Duration(pollInterval) * time.Second)
-	attempts := 3
-	duration := 1
+	defer rI.Stop()
 
 	for {
 		select {
-		case <-pI.C:
-			a.Metrics.MetricGenerator(runtime.MemStats{})
+		case <-ctx.Done():
+			close(jobs)
+			a.finalReport(types, &wg)
+			return nil
 		case <-rI.C:
-			err := db.Retry(attempts, time.Duration(duration), func() error {
-				err := a.PostMetrics("url")
-				return err
-			})
-			if err != nil {
-				log.Print(err)
+			if a.Outbox != nil && !a.Outbox.Empty() && a.throttled() == nil && a.replaying.CompareAndSwap(false, true) {
+				a.enqueue(ctx, jobs, []job{a.replayJob(types)})
+			}
+			a.enqueue(ctx, jobs, a.reportJobs(types, a.Metrics.Reserve()))
+		}
+	}
+}
+
+// enqueue Ставит запросы в очередь отправителей, ожидая свободного места, пока не отменён ctx.
+// Не попавшие в очередь приращения счётчиков возвращаются для финальной отправки
+func (a *Agent) enqueue(ctx context.Context, jobs chan<- job, report []job) {
+	for i, j := range report {
+		select {
+		case <-ctx.Done():
+			for _, rest := range report[i:] {
+				a.done(rest, ctx.Err())
 			}
+			return
+		case jobs <- j:
+		}
+	}
+}
+
+// finalReport Дожидается отправителей и отправляет накопленные метрики при остановке агента, всё вместе не дольше ShutdownTimeout.
+// Перед этим агент пробует отправить очередь на диске, неотправленное остаётся в ней до следующего запуска
+func (a *Agent) finalReport(types string, senders *sync.WaitGroup) {
+	done := make(chan error, 1)
+	go func() {
+		senders.Wait()
+		if a.Outbox != nil && !a.Outbox.Empty() {
+			if err := a.replay(types); err != nil {
+				log.Printf("outbox wasn't replayed, err: %v", err)
+			}
+		}
+		done <- a.PostMetrics(types)
+	}()
+
+	var timeout <-chan time.Time
+	if a.ShutdownTimeout > 0 {
+		timer := time.NewTimer(a.ShutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Printf("can't send the final report, err: %v", err)
+			return
 		}
+		log.Print("Final report was sent")
+	case <-timeout:
+		log.Printf("final report wasn't sent in %s", a.ShutdownTimeout)
 	}
 }
@@ -1,13 +1,24 @@
 package agent
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"github.com/CvitoyBamp/metricsexporter/internal/handlers"
+	"github.com/CvitoyBamp/metricsexporter/internal/metrics"
+	"github.com/CvitoyBamp/metricsexporter/internal/outbox"
+	"github.com/CvitoyBamp/metricsexporter/internal/rpc"
 	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"github.com/CvitoyBamp/metricsexporter/internal/subnet"
 	"github.com/stretchr/testify/require"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -147,3 +158,464 @@ func TestMetricCreatorHandler(t *testing.T) {
 		})
 	}
 }
+
+// testServer Сервер метрик для тестов агента с хранилищем в памяти
+type testServer struct {
+	*httptest.Server
+	repo *storage.MemStorage
+}
+
+// address Адрес сервера без схемы, как его принимает агент
+func (ts *testServer) address() string {
+	return ts.Listener.Addr().String()
+}
+
+// metric Значение метрики без меток на сервере
+func (ts *testServer) metric(t *testing.T, metricType, metricName string) string {
+	t.Helper()
+	val, err := ts.repo.GetMetric(context.Background(), metricType, metricName, nil)
+	require.NoError(t, err)
+	return val
+}
+
+type testServerConfig struct {
+	server  *handlers.CustomServer
+	handler func(next http.Handler) http.Handler
+	tls     bool
+}
+
+type testServerOption func(cfg *testServerConfig)
+
+// withKey Сервер проверяет подпись запросов ключом key
+func withKey(key string) testServerOption {
+	return func(cfg *testServerConfig) {
+		cfg.server.Config.Key = key
+	}
+}
+
+// withTrustedSubnet Сервер принимает метрики только из подсети trusted
+func withTrustedSubnet(trusted *net.IPNet) testServerOption {
+	return func(cfg *testServerConfig) {
+		cfg.server.TrustedSubnet = trusted
+	}
+}
+
+// withTLS Сервер работает по HTTPS
+func withTLS() testServerOption {
+	return func(cfg *testServerConfig) {
+		cfg.tls = true
+	}
+}
+
+// withHandler Запросы проходят через handler перед роутером сервера
+func withHandler(handler func(next http.Handler) http.Handler) testServerOption {
+	return func(cfg *testServerConfig) {
+		cfg.handler = handler
+	}
+}
+
+// newTestServer Запускает сервер метрик, который останавливается по окончании теста
+func newTestServer(t *testing.T, opts ...testServerOption) *testServer {
+	t.Helper()
+
+	repo := storage.CreateMemStorage()
+	cfg := &testServerConfig{
+		server: &handlers.CustomServer{
+			Storage: repo,
+			Config:  &handlers.Config{Address: "localhost:8080"},
+		},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	var handler http.Handler = cfg.server.MetricRouter()
+	if cfg.handler != nil {
+		handler = cfg.handler(handler)
+	}
+
+	var ts *httptest.Server
+	if cfg.tls {
+		ts = httptest.NewTLSServer(handler)
+	} else {
+		ts = httptest.NewServer(handler)
+	}
+	t.Cleanup(ts.Close)
+
+	return &testServer{Server: ts, repo: repo}
+}
+
+// flakyHandler Отвечает 503, пока сервер выключен через down
+type flakyHandler struct {
+	next http.Handler
+	down atomic.Bool
+}
+
+func (h *flakyHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if h.down.Load() {
+		http.Error(res, "maintenance", http.StatusServiceUnavailable)
+		return
+	}
+	h.next.ServeHTTP(res, req)
+}
+
+// withFlaky Запросы проходят через h
+func withFlaky(h *flakyHandler) testServerOption {
+	return withHandler(func(next http.Handler) http.Handler {
+		h.next = next
+		return h
+	})
+}
+
+func TestAgent_Signed(t *testing.T) {
+	ts := newTestServer(t, withKey("secret"))
+
+	a := CreateAgent(ts.address(), "")
+	require.Error(t, a.PostMetricURL("gauge", "testGauge", "1.0"))
+
+	a.Key = "secret"
+	require.NoError(t, a.PostMetricURL("gauge", "testGauge", "1.0"))
+}
+
+func TestAgent_TLS(t *testing.T) {
+	ts := newTestServer(t, withTLS())
+
+	a := CreateAgent(ts.address(), "")
+	require.Error(t, a.PostMetricURL("gauge", "testGauge", "1.0"))
+
+	a.EnableTLS(ts.Client().Transport.(*http.Transport).TLSClientConfig)
+	require.NoError(t, a.PostMetricURL("gauge", "testGauge", "1.0"))
+}
+
+func TestAgent_TrustedSubnet(t *testing.T) {
+	tests := []struct {
+		testName string
+		subnet   string
+		allowed  bool
+	}{
+		{testName: "Agent outside trusted subnet", subnet: "10.0.0.0/8", allowed: false},
+		{testName: "Agent inside trusted subnet", subnet: "127.0.0.0/8", allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			trusted, err := subnet.Parse(tt.subnet)
+			require.NoError(t, err)
+			ts := newTestServer(t, withTrustedSubnet(trusted))
+
+			a := CreateAgent(ts.address(), "")
+			err = a.PostMetricURL("gauge", "testGauge", "1.0")
+			if tt.allowed {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestOutboundIP(t *testing.T) {
+	var o outboundIP
+	_, err := o.get("localhost:bad-port")
+	require.Error(t, err)
+
+	ip, err := o.get("127.0.0.1:8080")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", ip)
+
+	// Найденный адрес не определяется заново
+	ip, err = o.get("localhost:bad-port")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", ip)
+}
+
+func TestAgent_GRPC(t *testing.T) {
+	repo := storage.CreateMemStorage()
+	s := rpc.CreateServer(repo, storage.CreateAgentRegistry(), rpc.Options{Key: "secret"})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(listener)
+	defer s.Stop()
+
+	a := CreateAgent("", "host-1")
+	a.Key = "secret"
+	require.NoError(t, a.DialGRPC(listener.Addr().String(), nil))
+	defer a.CloseGRPC()
+
+	a.Metrics.Gauge["testGauge"] = 1.5
+	require.NoError(t, a.PostMetrics("grpc"))
+
+	val, err := repo.GetMetric(context.Background(), "gauge", "testGauge", storage.Labels{storage.InstanceLabel: "host-1"})
+	require.NoError(t, err)
+	require.Equal(t, "1.5", val)
+}
+
+func TestAgent_Batch(t *testing.T) {
+	ts := newTestServer(t)
+
+	a := CreateAgent(ts.address(), "")
+	a.Metrics.Gauge["testGauge"] = 1.5
+	a.Metrics.Counter["testCounter"] = 2
+	require.NoError(t, a.PostMetrics(ModeBatch))
+	// Приращение счётчика уже подтверждено, повторная отправка его не удваивает
+	require.NoError(t, a.PostMetrics(ModeJSON))
+
+	require.Equal(t, "2", ts.metric(t, "counter", "testCounter"))
+}
+
+func TestAgent_FinalReport(t *testing.T) {
+	ts := newTestServer(t)
+
+	a := CreateAgent(ts.address(), "")
+	a.ShutdownTimeout = time.Second
+	a.Metrics.Gauge["testGauge"] = 1.5
+
+	// Интервал отправки больше времени работы агента, поэтому метрика доходит только с финальной отправкой
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.NoError(t, a.RunAgent(ctx, 60, 60))
+
+	require.Equal(t, "1.5", ts.metric(t, "gauge", "testGauge"))
+}
+
+func TestAgent_RateLimit(t *testing.T) {
+	var inFlight, maxInFlight int32
+	ts := newTestServer(t, withHandler(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for m := atomic.LoadInt32(&maxInFlight); n > m && !atomic.CompareAndSwapInt32(&maxInFlight, m, n); m = atomic.LoadInt32(&maxInFlight) {
+			}
+			time.Sleep(20 * time.Millisecond)
+			next.ServeHTTP(res, req)
+		})
+	}))
+
+	a := CreateAgent(ts.address(), "")
+	a.Mode = ModeURL
+	a.RateLimit = 2
+	a.ShutdownTimeout = time.Second
+	for i := 0; i < 10; i++ {
+		a.Metrics.Gauge["testGauge"+strconv.Itoa(i)] = float64(i)
+	}
+	// Воспроизведение очереди на диске выполняют те же отправители
+	var err error
+	a.Outbox, err = outbox.CreateOutbox(t.TempDir(), outbox.Options{})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, a.Outbox.Append([]byte(`[{"id":"PollCount","type":"counter","delta":1}]`)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	require.NoError(t, a.RunAgent(ctx, 60, 1))
+
+	require.NotZero(t, atomic.LoadInt32(&maxInFlight))
+	require.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(2))
+	require.True(t, a.Outbox.Empty())
+}
+
+type testCollector struct{}
+
+func (testCollector) Name() string { return "test" }
+
+func (testCollector) Interval() time.Duration { return 10 * time.Millisecond }
+
+func (testCollector) Collect(context.Context) ([]metrics.Metric, error) {
+	return []metrics.Metric{metrics.Counter("testCounter", 1)}, nil
+}
+
+func TestAgent_Collectors(t *testing.T) {
+	ts := newTestServer(t)
+
+	a := CreateAgent(ts.address(), "")
+	a.ShutdownTimeout = time.Second
+	require.True(t, a.Collectors.Unregister("runtime"))
+	require.NoError(t, a.Collectors.Register(testCollector{}))
+	require.Error(t, a.Collectors.Register(testCollector{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.NoError(t, a.RunAgent(ctx, 60, 60))
+
+	_, err := ts.repo.GetMetric(context.Background(), "counter", "testCounter", nil)
+	require.NoError(t, err)
+	_, err = ts.repo.GetMetric(context.Background(), "counter", "PollCount", nil)
+	require.Error(t, err)
+}
+
+func TestAgent_CounterDeltas(t *testing.T) {
+	flaky := &flakyHandler{}
+	flaky.down.Store(true)
+	ts := newTestServer(t, withFlaky(flaky))
+
+	a := CreateAgent(ts.address(), "")
+	a.Metrics.Apply([]metrics.Metric{metrics.Counter("PollCount", 2)})
+	require.Error(t, a.PostMetrics(ModeBatch))
+
+	// Неотправленное приращение копится вместе с новыми
+	a.Metrics.Apply([]metrics.Metric{metrics.Counter("PollCount", 1)})
+	flaky.down.Store(false)
+	require.NoError(t, a.PostMetrics(ModeURL))
+	require.NoError(t, a.PostMetrics(ModeBatch))
+
+	require.Equal(t, "3", ts.metric(t, "counter", "PollCount"))
+}
+
+func TestAgent_Outbox(t *testing.T) {
+	flaky := &flakyHandler{}
+	flaky.down.Store(true)
+	ts := newTestServer(t, withFlaky(flaky))
+
+	a := CreateAgent(ts.address(), "")
+	a.ShutdownTimeout = time.Second
+	var err error
+	a.Outbox, err = outbox.CreateOutbox(t.TempDir(), outbox.Options{SegmentSize: 1 << 20})
+	require.NoError(t, err)
+
+	// Пока сервер недоступен, отчёты откладываются на диск
+	a.Metrics.Apply([]metrics.Metric{metrics.Gauge("testGauge", 1), metrics.Counter("PollCount", 2)})
+	require.NoError(t, a.PostMetrics(ModeBatch))
+	a.Metrics.Apply([]metrics.Metric{metrics.Gauge("testGauge", 2), metrics.Counter("PollCount", 1)})
+	require.NoError(t, a.PostMetrics(ModeBatch))
+	require.False(t, a.Outbox.Empty())
+
+	flaky.down.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.NoError(t, a.RunAgent(ctx, 60, 60))
+	require.True(t, a.Outbox.Empty())
+
+	require.Equal(t, "3", ts.metric(t, "counter", "PollCount"))
+	require.Equal(t, "2", ts.metric(t, "gauge", "testGauge"))
+}
+
+func TestAgent_OutboxPartialReplay(t *testing.T) {
+	// Сервер без /updates/, который не принимает testCounter, пока down выставлен
+	var down atomic.Bool
+	down.Store(true)
+	ts := newTestServer(t, withHandler(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/updates/" {
+				http.NotFound(res, req)
+				return
+			}
+			gz, err := gzip.NewReader(req.Body)
+			require.NoError(t, err)
+			body, err := io.ReadAll(gz)
+			require.NoError(t, err)
+			if down.Load() && bytes.Contains(body, []byte(`"id":"testCounter"`)) {
+				http.Error(res, "maintenance", http.StatusServiceUnavailable)
+				return
+			}
+			req.Header.Del("Content-Encoding")
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(res, req)
+		})
+	}))
+
+	a := CreateAgent(ts.address(), "")
+	a.Retry.MaxAttempts = 1
+	var err error
+	a.Outbox, err = outbox.CreateOutbox(t.TempDir(), outbox.Options{})
+	require.NoError(t, err)
+	record := `{"id":"testGauge","type":"gauge","value":1},{"id":"testCounter","type":"counter","delta":3}`
+	for i := 0; i < 5; i++ {
+		record += `,{"id":"PollCount` + strconv.Itoa(i) + `","type":"counter","delta":2}`
+	}
+	require.NoError(t, a.Outbox.Append([]byte("["+record+"]")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, a.RunAgent(ctx, 60, 60))
+	require.False(t, a.Outbox.Empty())
+
+	// Принятые сервером приращения не отправляются второй раз
+	down.Store(false)
+	require.NoError(t, a.RunAgent(ctx, 60, 60))
+	require.True(t, a.Outbox.Empty())
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, "2", ts.metric(t, "counter", "PollCount"+strconv.Itoa(i)))
+	}
+	require.Equal(t, "3", ts.metric(t, "counter", "testCounter"))
+	require.Equal(t, "1", ts.metric(t, "gauge", "testGauge"))
+}
+
+func TestAgent_RetryAfter(t *testing.T) {
+	var requests int32
+	ts := newTestServer(t, withHandler(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&requests, 1) == 1 {
+				res.Header().Set("Retry-After", "60")
+				http.Error(res, "maintenance", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(res, req)
+		})
+	}))
+
+	a := CreateAgent(ts.address(), "")
+	a.Metrics.Apply([]metrics.Metric{metrics.Counter("PollCount", 2)})
+	require.Error(t, a.PostMetrics(ModeBatch))
+
+	// До конца Retry-After агент не обращается к серверу, приращение копится
+	a.Metrics.Apply([]metrics.Metric{metrics.Counter("PollCount", 1)})
+	require.Error(t, a.PostMetrics(ModeBatch))
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	require.Equal(t, int64(3), a.Metrics.Counter["PollCount"])
+}
+
+func TestAgent_ReportModes(t *testing.T) {
+	// Старый сервер без /updates/
+	var batches int32
+	ts := newTestServer(t, withHandler(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/updates/" {
+				atomic.AddInt32(&batches, 1)
+				http.NotFound(res, req)
+				return
+			}
+			next.ServeHTTP(res, req)
+		})
+	}))
+
+	a := CreateAgent(ts.address(), "")
+	require.Error(t, a.PostMetrics("unknown"))
+	require.Error(t, a.PostMetrics(ModeGRPC), "grpc needs a connection")
+	// Агент с неизвестным способом отправки не запускается, а не отправляет отчёты по URL
+	a.Mode = "unknown"
+	require.Error(t, a.RunAgent(context.Background(), 60, 60))
+	a.Mode = ""
+
+	a.Metrics.Apply([]metrics.Metric{metrics.Gauge("testGauge", 1.5), metrics.Counter("PollCount", 2)})
+	require.NoError(t, a.PostMetrics(ModeBatch))
+	a.Metrics.Apply([]metrics.Metric{metrics.Counter("PollCount", 1)})
+	require.NoError(t, a.PostMetrics(ModeBatch))
+	require.Equal(t, int32(1), atomic.LoadInt32(&batches), "batches aren't sent after 404")
+
+	require.Equal(t, "3", ts.metric(t, "counter", "PollCount"))
+	require.Equal(t, "1.5", ts.metric(t, "gauge", "testGauge"))
+}
+
+func TestAgent_BatchChunks(t *testing.T) {
+	var batches int32
+	ts := newTestServer(t, withHandler(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&batches, 1)
+			next.ServeHTTP(res, req)
+		})
+	}))
+
+	a := CreateAgent(ts.address(), "host-1")
+	a.MaxBatchSize = 200
+	for i := 0; i < 10; i++ {
+		a.Metrics.Gauge["testGauge"+strconv.Itoa(i)] = float64(i)
+	}
+	require.NoError(t, a.PostMetrics(ModeBatch))
+	require.Greater(t, atomic.LoadInt32(&batches), int32(1))
+
+	list, err := ts.repo.ListMetrics(context.Background())
+	require.NoError(t, err)
+	require.Len(t, list, 10)
+}
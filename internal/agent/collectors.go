@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/metrics"
+	"log"
+	"sync"
+	"time"
+)
+
+// CollectorRegistry Сборщики метрик, которые агент запускает в RunAgent, в порядке регистрации
+type CollectorRegistry struct {
+	mu         sync.RWMutex
+	collectors []metrics.Collector
+}
+
+func CreateCollectorRegistry() *CollectorRegistry {
+	return &CollectorRegistry{}
+}
+
+// Register Добавляет сборщик, имена сборщиков уникальны
+func (r *CollectorRegistry) Register(c metrics.Collector) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, registered := range r.collectors {
+		if registered.Name() == c.Name() {
+			return fmt.Errorf("collector %s is already registered", c.Name())
+		}
+	}
+	r.collectors = append(r.collectors, c)
+	return nil
+}
+
+// Unregister Убирает сборщик name, false - такого сборщика нет
+func (r *CollectorRegistry) Unregister(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, c := range r.collectors {
+		if c.Name() == name {
+			r.collectors = append(r.collectors[:i], r.collectors[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// List Зарегистрированные сборщики
+func (r *CollectorRegistry) List() []metrics.Collector {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]metrics.Collector(nil), r.collectors...)
+}
+
+// runCollector Снимает метрики сборщиком c раз в его интервал, нулевой интервал заменяется defaultInterval
+func (a *Agent) runCollector(ctx context.Context, c metrics.Collector, defaultInterval time.Duration) {
+	interval := c.Interval()
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			collected, err := c.Collect(ctx)
+			if err != nil {
+				log.Printf("collector %s: %s", c.Name(), err)
+			}
+			a.Metrics.Apply(collected)
+		}
+	}
+}
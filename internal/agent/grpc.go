@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/metrics"
+	pb "github.com/CvitoyBamp/metricsexporter/internal/proto"
+	"github.com/CvitoyBamp/metricsexporter/internal/retry"
+	"github.com/CvitoyBamp/metricsexporter/internal/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log"
+)
+
+// DialGRPC Подключает агента к gRPC-сервису метрик по адресу address. С tlsConfig соединение защищается TLS.
+// После подключения агент отправляет метрики через gRPC вместо HTTP
+func (a *Agent) DialGRPC(address string, tlsConfig *tls.Config) error {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("can't connect to gRPC server %s, err: %v", address, err)
+	}
+
+	a.grpcAddress = address
+	a.grpcConn = conn
+	a.GRPCClient = pb.NewMetricsClient(conn)
+	return nil
+}
+
+// CloseGRPC Закрывает соединение с gRPC-сервером
+func (a *Agent) CloseGRPC() error {
+	if a.grpcConn == nil {
+		return nil
+	}
+	return a.grpcConn.Close()
+}
+
+// PostMetricsGRPC Отправляет снимок метрик одной пачкой через gRPC
+func (a *Agent) PostMetricsGRPC(s metrics.Snapshot) error {
+	req := &pb.UpdateMetricsRequest{
+		Metrics: make([]*pb.Metric, 0, len(s.Gauge)+len(s.Counter)),
+	}
+	for k, v := range s.Gauge {
+		req.Metrics = append(req.Metrics, &pb.Metric{Id: k, Type: pb.Metric_GAUGE, Labels: a.labels(), Value: v})
+	}
+	for k, v := range s.Counter {
+		req.Metrics = append(req.Metrics, &pb.Metric{Id: k, Type: pb.Metric_COUNTER, Labels: a.labels(), Delta: v})
+	}
+
+	md := metadata.MD{}
+	if a.Key != "" {
+		sign, err := rpc.SignMessage(req, a.Key)
+		if err != nil {
+			return fmt.Errorf("can't sign request, err: %v", err)
+		}
+		md.Set(rpc.HashMetadata, sign)
+	}
+	if realIP, err := a.grpcRealIP.get(a.grpcAddress); err == nil {
+		md.Set(rpc.RealIPMetadata, realIP)
+	} else {
+		log.Print(err)
+	}
+
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), md), a.Client.Timeout)
+	defer cancel()
+
+	if _, err := a.GRPCClient.UpdateMetrics(ctx, req); err != nil {
+		log.Printf("can't send batch of metrics over gRPC")
+		return fmt.Errorf("can't send metrics over gRPC, err: %w", err)
+	}
+
+	log.Printf("Batch of metrics was successfully sent over gRPC.")
+
+	return nil
+}
+
+// retryable Дополняет retry.IsRetryable кодами gRPC, после которых отправку стоит повторить
+func retryable(err error) bool {
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+			return true
+		}
+	}
+	return retry.IsRetryable(err)
+}
@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/json"
+	"github.com/CvitoyBamp/metricsexporter/internal/metrics"
+	"github.com/CvitoyBamp/metricsexporter/internal/retry"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Способы отправки отчётов
+const (
+	ModeURL   = "url"   // по запросу на метрику, значение в пути /update/
+	ModeJSON  = "json"  // по запросу на метрику, JSON в /update/
+	ModeBatch = "batch" // пачками JSON в /updates/
+	ModeGRPC  = "grpc"  // пачками через gRPC, нужно подключение DialGRPC
+)
+
+// Modes Поддерживаемые способы отправки отчётов
+var Modes = []string{ModeURL, ModeJSON, ModeBatch, ModeGRPC}
+
+// ValidateMode Проверяет, что агент умеет отправлять отчёты способом mode
+func ValidateMode(mode string) error {
+	for _, m := range Modes {
+		if m == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown report mode %q, expected one of: %s", mode, strings.Join(Modes, ", "))
+}
+
+// validateMode Проверяет, что агент может отправлять отчёты способом mode: для grpc нужно подключение DialGRPC
+func (a *Agent) validateMode(mode string) error {
+	if err := ValidateMode(mode); err != nil {
+		return err
+	}
+	if mode == ModeGRPC && a.GRPCClient == nil {
+		return fmt.Errorf("report mode %s needs a gRPC connection", mode)
+	}
+	return nil
+}
+
+// mode Способ отправки отчётов с учётом значения по умолчанию
+func (a *Agent) mode() string {
+	switch {
+	case a.Mode != "":
+		return a.Mode
+	case a.GRPCClient != nil:
+		return ModeGRPC
+	default:
+		return ModeBatch
+	}
+}
+
+// once Выполняет запрос один раз, без повторов
+func once(send func() error) error {
+	return send()
+}
+
+// postBatch Отправляет пачку и запоминает, что сервер не принимает пачки, если /updates/ отвечает 404
+func (a *Agent) postBatch(s metrics.Snapshot) error {
+	err := a.PostMetricsBatch(s)
+
+	var statusErr *retry.StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		if !a.batchUnsupported.Swap(true) {
+			log.Print("server doesn't support batches, metrics are sent one by one in JSON")
+		}
+	}
+	return err
+}
+
+// splitSnapshot Делит снимок на части, в которых метрики с метками labels в JSON занимают не больше maxSize байт.
+// Метрика больше maxSize отправляется отдельной частью, maxSize <= 0 - снимок не делится
+func splitSnapshot(s metrics.Snapshot, maxSize int, labels storage.Labels) []metrics.Snapshot {
+	if maxSize <= 0 || len(s.Gauge)+len(s.Counter) == 0 {
+		return []metrics.Snapshot{s}
+	}
+
+	var chunks []metrics.Snapshot
+	var current metrics.Snapshot
+	size := 0
+	add := func(metricType, name, value string) {
+		data, _ := json.Creator(value, metricType, name, labels)
+		// Запятая между метриками в списке
+		metricSize := len(data) + 1
+		if size > 0 && size+metricSize > maxSize {
+			chunks = append(chunks, current)
+			current, size = metrics.Snapshot{}, 0
+		}
+		size += metricSize
+	}
+
+	for _, name := range sortedKeys(s.Gauge) {
+		add("gauge", name, strconv.FormatFloat(s.Gauge[name], 'f', -1, 64))
+		if current.Gauge == nil {
+			current.Gauge = make(map[string]float64)
+		}
+		current.Gauge[name] = s.Gauge[name]
+	}
+	for _, name := range sortedKeys(s.Counter) {
+		add("counter", name, strconv.FormatInt(s.Counter[name], 10))
+		if current.Counter == nil {
+			current.Counter = make(map[string]int64)
+		}
+		current.Counter[name] = s.Counter[name]
+	}
+	return append(chunks, current)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/json"
+	"github.com/CvitoyBamp/metricsexporter/internal/metrics"
+	"github.com/CvitoyBamp/metricsexporter/internal/outbox"
+	"log"
+)
+
+// deliver Отправляет запрос через do. Пока очередь на диске не пуста, запрос встаёт в её конец,
+// чтобы сервер получил отчёты по порядку, а запрос, который не удалось отправить или который сервер
+// просил отложить через Retry-After, откладывается в неё
+func (a *Agent) deliver(j job, do func(send func() error) error) error {
+	if a.Outbox != nil && !a.Outbox.Empty() {
+		return a.spool(j)
+	}
+
+	err := do(func() error { return a.sendNow(j.send) })
+	if err != nil && j.batch && a.batchUnsupported.Load() {
+		return a.deliverAll(a.reportJobs(ModeJSON, j.snapshot), do)
+	}
+	if err != nil && a.Outbox != nil {
+		log.Printf("report is spooled to outbox, err: %v", err)
+		return a.spool(j)
+	}
+	a.done(j, err)
+	return err
+}
+
+// deliverAll Отправляет все запросы, не останавливаясь на ошибках
+func (a *Agent) deliverAll(jobs []job, do func(send func() error) error) error {
+	var errs []error
+	for _, j := range jobs {
+		if err := a.deliver(j, do); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// spool Откладывает запрос в очередь на диске. Отложенные приращения счётчиков считаются отправленными
+func (a *Agent) spool(j job) error {
+	data, err := json.ListCreator(j.snapshot.Gauge, j.snapshot.Counter, nil)
+	if err == nil {
+		err = a.Outbox.Append(data)
+	}
+	a.done(j, err)
+	if err != nil {
+		return fmt.Errorf("can't spool report to outbox, err: %v", err)
+	}
+	return nil
+}
+
+// replay Отправляет отложенные отчёты по порядку, пока сервер их принимает.
+// Если отчёт отправлен частично, в очереди вместо него остаются неотправленные метрики,
+// чтобы при следующей попытке не отправить приращения счётчиков второй раз
+func (a *Agent) replay(types string) error {
+	return a.Outbox.Replay(func(record []byte) error {
+		gm, cm, err := json.ListDecoder(record)
+		if err != nil {
+			log.Printf("can't decode outbox record, it's skipped: %v", err)
+			return nil
+		}
+		rest, err := a.sendAll(a.reportJobs(types, metrics.Snapshot{Gauge: gm, Counter: cm}))
+		if err == nil || len(rest.Gauge)+len(rest.Counter) == len(gm)+len(cm) {
+			return err
+		}
+		data, errJSON := json.ListCreator(rest.Gauge, rest.Counter, nil)
+		if errJSON != nil {
+			return err
+		}
+		return &outbox.PartialError{Rest: data, Err: err}
+	})
+}
+
+// sendAll Отправляет запросы без учёта очереди на диске до первой ошибки и возвращает метрики, которые не отправлены.
+// Пачку, которую сервер не принял из-за отсутствия /updates/, переотправляет по одной метрике
+func (a *Agent) sendAll(jobs []job) (metrics.Snapshot, error) {
+	for i, j := range jobs {
+		err := a.sendNow(j.send)
+		rest := j.snapshot
+		if err != nil && j.batch && a.batchUnsupported.Load() {
+			rest, err = a.sendAll(a.reportJobs(ModeJSON, j.snapshot))
+		}
+		if err != nil {
+			for _, next := range jobs[i+1:] {
+				rest = merge(rest, next.snapshot)
+			}
+			return rest, err
+		}
+	}
+	return metrics.Snapshot{}, nil
+}
+
+// merge Объединяет непересекающиеся части снимка
+func merge(dst, src metrics.Snapshot) metrics.Snapshot {
+	for k, v := range src.Gauge {
+		if dst.Gauge == nil {
+			dst.Gauge = make(map[string]float64)
+		}
+		dst.Gauge[k] = v
+	}
+	for k, v := range src.Counter {
+		if dst.Counter == nil {
+			dst.Counter = make(map[string]int64)
+		}
+		dst.Counter[k] = v
+	}
+	return dst
+}
+
+// replayJob Запрос на воспроизведение очереди на диске. Его выполняет один из отправителей,
+// поэтому воспроизведение не превышает RateLimit одновременных запросов
+func (a *Agent) replayJob(types string) job {
+	return job{
+		send: func() error {
+			defer a.replaying.Store(false)
+			if err := a.replay(types); err != nil {
+				return fmt.Errorf("outbox wasn't replayed, err: %w", err)
+			}
+			log.Print("outbox was replayed")
+			return nil
+		},
+		replay: true,
+	}
+}
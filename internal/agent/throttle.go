@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/retry"
+	"log"
+	"time"
+)
+
+// throttledError Отправка пропущена: сервер через Retry-After просил не присылать отчёты до until
+type throttledError struct {
+	until time.Time
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("server asked not to send reports until %s", e.until.Format(time.RFC3339))
+}
+
+// throttled Возвращает ошибку, если сервер просил подождать и время ещё не пришло
+func (a *Agent) throttled() error {
+	if until := a.notBefore.Load(); until > time.Now().UnixNano() {
+		return &throttledError{until: time.Unix(0, until)}
+	}
+	return nil
+}
+
+// observe Запоминает, до какого времени сервер просил не присылать отчёты, если он ответил с Retry-After
+func (a *Agent) observe(err error) error {
+	var statusErr *retry.StatusError
+	if !errors.As(err, &statusErr) || statusErr.RetryAfter <= 0 {
+		return err
+	}
+
+	until := time.Now().Add(statusErr.RetryAfter).UnixNano()
+	for {
+		current := a.notBefore.Load()
+		if until <= current {
+			return err
+		}
+		if a.notBefore.CompareAndSwap(current, until) {
+			log.Printf("server asked to retry after %s, reports are postponed", statusErr.RetryAfter)
+			return err
+		}
+	}
+}
+
+// sendNow Отправляет запрос, если сервер не просил подождать, и запоминает его просьбу подождать из ответа
+func (a *Agent) sendNow(send func() error) error {
+	if err := a.throttled(); err != nil {
+		return err
+	}
+	return a.observe(send())
+}
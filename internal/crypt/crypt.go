@@ -0,0 +1,160 @@
+// Package crypt Гибридное шифрование тел запросов агента: данные шифруются AES-256-GCM на случайном ключе,
+// а сам ключ - открытым ключом RSA-OAEP (SHA-256), поэтому размер тела не ограничен размером RSA-ключа
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header Заголовок, которым агент помечает зашифрованное тело запроса
+const Header = "Encryption"
+
+// Scheme Значение заголовка Encryption для гибридной схемы RSA-OAEP + AES-GCM
+const Scheme = "rsa-oaep-aes-gcm"
+
+const aesKeySize = 32
+
+// Encrypt Шифрует данные: [длина зашифрованного ключа, 2 байта][зашифрованный ключ][nonce][шифртекст]
+func Encrypt(pub *rsa.PublicKey, data []byte) ([]byte, error) {
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("can't generate session key: %w", err)
+	}
+
+	encKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't encrypt session key: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("can't generate nonce: %w", err)
+	}
+
+	out := make([]byte, 2, 2+len(encKey)+len(nonce)+len(data)+gcm.Overhead())
+	binary.BigEndian.PutUint16(out, uint16(len(encKey)))
+	out = append(out, encKey...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, data, nil), nil
+}
+
+// Decrypt Расшифровывает данные, зашифрованные Encrypt
+func Decrypt(priv *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, errors.New("encrypted data is too short")
+	}
+	keyLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < keyLen {
+		return nil, errors.New("encrypted data is too short")
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, data[:keyLen], nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt session key: %w", err)
+	}
+	data = data[keyLen:]
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt data: %w", err)
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("can't create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateKeys Создаёт пару ключей RSA и возвращает их в PEM: закрытый в PKCS#1, открытый в PKIX
+func GenerateKeys(bits int) (privPEM, pubPEM []byte, err error) {
+	priv, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	privPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	pubPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+	return privPEM, pubPEM, nil
+}
+
+// LoadPublicKey Читает открытый ключ RSA из PEM-файла (PKIX или PKCS#1)
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, errPKCS1 := x509.ParsePKCS1PublicKey(block.Bytes); errPKCS1 == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse public key %s: %w", path, err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %s is not an RSA key", path)
+	}
+	return pub, nil
+}
+
+// LoadPrivateKey Читает закрытый ключ RSA из PEM-файла (PKCS#1 или PKCS#8)
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, errPKCS1 := x509.ParsePKCS1PrivateKey(block.Bytes); errPKCS1 == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse private key %s: %w", path, err)
+	}
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key %s is not an RSA key", path)
+	}
+	return priv, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	return block, nil
+}
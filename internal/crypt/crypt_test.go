@@ -0,0 +1,41 @@
+package crypt
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	privPEM, pubPEM, err := GenerateKeys(2048)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	privPath := filepath.Join(dir, "private.pem")
+	pubPath := filepath.Join(dir, "public.pem")
+	require.NoError(t, os.WriteFile(privPath, privPEM, 0o600))
+	require.NoError(t, os.WriteFile(pubPath, pubPEM, 0o644))
+
+	priv, err := LoadPrivateKey(privPath)
+	require.NoError(t, err)
+	pub, err := LoadPublicKey(pubPath)
+	require.NoError(t, err)
+
+	// Тело больше, чем помещается в один блок RSA-OAEP
+	data := bytes.Repeat([]byte(`{"id":"Alloc","type":"gauge","value":1}`), 1000)
+
+	encrypted, err := Encrypt(pub, data)
+	require.NoError(t, err)
+	assert.NotEqual(t, data, encrypted)
+
+	decrypted, err := Decrypt(priv, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	encrypted[len(encrypted)-1] ^= 0xff
+	_, err = Decrypt(priv, encrypted)
+	assert.Error(t, err)
+}
@@ -2,218 +2,455 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/retry"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"io"
 	"log"
+	"net"
+	"sort"
 	"strconv"
 	"time"
 )
 
 const (
-	createGaugeTable = `CREATE TABLE IF NOT EXISTS gaugeMetrics(
-        id        serial PRIMARY KEY,
-        name      text NOT NULL,
-        value     double precision NOT NULL,
-        timestamp timestamp,
-        UNIQUE (name))`
-	createCounterTable = `CREATE TABLE IF NOT EXISTS counterMetrics(
-        id        serial PRIMARY KEY,
-        name      text NOT NULL,
-        value     bigint NOT NULL,
-        timestamp timestamp,
-        UNIQUE (name))`
 	clearCounter = `DELETE FROM counterMetrics`
-	getCount     = `WITH counter_count AS (SELECT COUNT(*) cc FROM counterMetrics),
-                     gauge_count AS (SELECT COUNT(*) gc FROM gaugeMetrics)
-        SELECT cc + gc AS sum_count
-        FROM counter_count, gauge_count`
+	clearGauge   = `DELETE FROM gaugeMetrics`
+	clearSamples = `DELETE FROM metricSamples`
+	clearRollups = `DELETE FROM metricRollups`
+	// Каждое обновление значения сразу пишется и в историю метрики
+	upsertCounter = `WITH upserted AS (
+            INSERT INTO counterMetrics (name, labels, value, timestamp)
+            VALUES ($1, $2::jsonb, $3, $4)
+            ON CONFLICT (name, labels) DO
+            UPDATE SET value = counterMetrics.value + EXCLUDED.value, timestamp = EXCLUDED.timestamp
+            RETURNING name, labels, value, timestamp)
+        INSERT INTO metricSamples (type, name, labels, value, timestamp)
+        SELECT 'counter', name, labels, value, timestamp FROM upserted`
+	upsertGauge = `WITH upserted AS (
+            INSERT INTO gaugeMetrics (name, labels, value, timestamp)
+            VALUES ($1, $2::jsonb, $3, $4)
+            ON CONFLICT (name, labels) DO UPDATE SET value = EXCLUDED.value, timestamp = EXCLUDED.timestamp
+            RETURNING name, labels, value, timestamp)
+        INSERT INTO metricSamples (type, name, labels, value, timestamp)
+        SELECT 'gauge', name, labels, value, timestamp FROM upserted`
+	listMetrics = `SELECT 'gauge', name, labels, value::text FROM gaugeMetrics
+        UNION ALL
+        SELECT 'counter', name, labels, value::text FROM counterMetrics`
 )
 
-type Database struct {
-	Conn *pgx.Conn
+const (
+	healthCheckPeriod = 15 * time.Second
+	maxConnIdleTime   = 5 * time.Minute
+	reconnectAttempts = 3
+)
+
+// connectPolicy Повторы подключения к БД при старте
+var connectPolicy = retry.Policy{
+	MaxAttempts: 4,
+	BaseDelay:   time.Second,
+	MaxDelay:    5 * time.Second,
+	Retryable:   isConnectionError,
 }
 
-type Metrics struct {
-	metricType  string
-	metricName  string
-	metricValue string
+// readPolicy Повторы чтения после обрыва соединения
+var readPolicy = retry.Policy{
+	MaxAttempts: reconnectAttempts + 1,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    time.Second,
+	Retryable:   isConnectionError,
 }
 
-func Retry(attempts int, sleep time.Duration, f func() error) (err error) {
-	for i := 1; i <= attempts; i++ {
-		log.Printf("This is attempt number %d", i)
-		err = f()
-		if err != nil {
-			log.Printf("error occured after attempt number %d: %s", i+1, err.Error())
-			log.Println("sleeping for: ", sleep.Seconds())
-			time.Sleep(sleep)
-			sleep += 2 * time.Second
-			continue
-		}
-		break
+// writePolicy Повторы записи после обрыва соединения. Запись повторяется, только если она точно
+// не дошла до БД, иначе повтор заново прибавил бы приращения счётчиков
+var writePolicy = retry.Policy{
+	MaxAttempts: reconnectAttempts + 1,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    time.Second,
+	Retryable:   isSafeToRetry,
+}
+
+// notSentError Ошибка получения соединения из пула или начала транзакции, то есть до отправки записи в БД
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notSentError) Unwrap() error {
+	return e.err
+}
+
+type Database struct {
+	Pool *pgxpool.Pool
+}
+
+// CreateDB Создаёт пул соединений к Postgres и применяет миграции
+func CreateDB(pgURL string, maxConns int32) *Database {
+
+	db := ConnectDB(pgURL, maxConns)
+
+	err := db.Migrate(context.Background())
+	if err != nil {
+		log.Fatalf("Can't migrate database schema, err: %s", err)
 	}
-	return
+
+	return db
 }
 
-func CreateDB(pgURL string) *Database {
+// ConnectDB Создаёт пул соединений к Postgres и дожидается доступности БД
+func ConnectDB(pgURL string, maxConns int32) *Database {
 
 	var db Database
 
-	attempts := 3
-	duration := 1
+	ctx := context.Background()
 
-	if pgURL != "" {
+	poolConfig, err := pgxpool.ParseConfig(pgURL)
+	if err != nil {
+		log.Fatalf("Can't parse URL of PG DB, err: %s", err)
+	}
 
-		ctx := context.Background()
+	if maxConns > 0 {
+		poolConfig.MaxConns = maxConns
+	}
+	poolConfig.HealthCheckPeriod = healthCheckPeriod
+	poolConfig.MaxConnIdleTime = maxConnIdleTime
 
-		connConfig, err := pgx.ParseConfig(pgURL)
+	db.Pool, err = pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		log.Fatalf("Can't create pool of connections to db, err: %s", err)
+	}
 
-		if err != nil {
-			log.Fatalf("Can't parse URL of PG DB, err: %s", err)
-		}
+	err = connectPolicy.Do(ctx, func() error {
+		return db.Pool.Ping(ctx)
+	})
+	if err != nil {
+		log.Fatalf("Can't create connect to db, err: %s", err)
+	}
 
-		db.Conn, err = pgx.ConnectConfig(ctx, connConfig)
+	return &db
+}
 
-		if err != nil {
-			if pgerrcode.IsConnectionException(err.Error()) {
-				err = Retry(attempts, time.Duration(duration), func() error {
+// isConnectionError Проверяет, что ошибка вызвана потерей соединения с БД (например, после её рестарта)
+func isConnectionError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgerrcode.IsConnectionException(pgErr.Code) ||
+			pgErr.Code == pgerrcode.AdminShutdown ||
+			pgErr.Code == pgerrcode.CrashShutdown ||
+			pgErr.Code == pgerrcode.CannotConnectNow
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || pgconn.SafeToRetry(err) || errors.Is(err, io.ErrUnexpectedEOF)
+}
 
-					db.Conn, err = pgx.ConnectConfig(ctx, connConfig)
+// isSafeToRetry Проверяет, что запись оборвалась из-за потери соединения до того, как что-то было отправлено в БД
+func isSafeToRetry(err error) bool {
+	var notSent *notSentError
+	if errors.As(err, &notSent) {
+		return isConnectionError(notSent.err)
+	}
+	return pgconn.SafeToRetry(err)
+}
 
-					return err
-				})
-				if err != nil {
-					log.Fatalf("Can't create connect to db, err: %s", err)
-				}
-			}
-			log.Fatalf("Can't create connect to db, err: %s", err)
+// withReconnect Выполняет запрос и при обрыве соединения пересоздаёт соединения пула и повторяет его по политике policy.
+// Если соединение так и не восстановилось, ошибка оборачивается в storage.ErrUnavailable
+func (db *Database) withReconnect(ctx context.Context, policy retry.Policy, f func() error) error {
+	err := policy.Do(ctx, func() error {
+		err := f()
+		if err != nil && isConnectionError(err) {
+			log.Printf("lost connection to db, reconnecting: %s", err)
+			db.Pool.Reset()
 		}
+		return err
+	})
+	if err != nil && isConnectionError(err) {
+		return fmt.Errorf("%w: %w", storage.ErrUnavailable, err)
+	}
+	return err
+}
 
-		_, err = db.Conn.Exec(context.Background(), createGaugeTable)
-		if err != nil {
-			log.Fatalf("Can't create table with gauge metrics, err: %s", err)
-		}
+// exec Выполняет запись на соединении из пула. Ошибка получения соединения отличается от ошибки самой записи
+func (db *Database) exec(ctx context.Context, query string, args ...any) error {
+	conn, err := db.Pool.Acquire(ctx)
+	if err != nil {
+		return &notSentError{err: err}
+	}
+	defer conn.Release()
 
-		_, err = db.Conn.Exec(context.Background(), createCounterTable)
-		if err != nil {
-			log.Fatalf("Can't create table with counter metrics, err: %s", err)
-		}
+	_, err = conn.Exec(ctx, query, args...)
+	return err
+}
 
-		_, err = db.Conn.Exec(context.Background(), clearCounter)
-		if err != nil {
-			log.Fatalf("Can't trunc counter table, err: %s", err)
-		}
+// begin Начинает транзакцию. Если она не началась, в БД ещё ничего не записано
+func (db *Database) begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return nil, &notSentError{err: err}
 	}
+	return tx, nil
+}
 
-	return &db
+func (db *Database) Ping(ctx context.Context) error {
+	return db.Pool.Ping(ctx)
 }
 
-func (db Database) CheckConnectivity() error {
-	return db.Conn.Ping(context.Background())
+func (db *Database) Close() error {
+	db.Pool.Close()
+	return nil
 }
 
-func (db Database) SetMetricDB(metricType, metricName, metricValue string) error {
+func (db *Database) SetMetric(ctx context.Context, metricType, metricName string, labels storage.Labels, metricValue string) error {
 	if metricType == "counter" {
 		value, err := strconv.ParseInt(metricValue, 10, 64)
 		if err != nil {
 			return fmt.Errorf("can't parse value to counter type (int64), error: %s", err)
 		}
-		_, err = db.Conn.Exec(context.Background(),
-			`INSERT INTO counterMetrics (name, value, timestamp)
-                 VALUES ($1, $2, $3)
-                 ON CONFLICT (name) DO 
-                 UPDATE SET value = (SELECT value FROM counterMetrics WHERE name = $1 ) + $2, timestamp = $3;`,
-			metricName, value, time.Now())
-		if err != nil {
-			return err
-		}
+		return db.withReconnect(ctx, writePolicy, func() error {
+			return db.exec(ctx, upsertCounter, metricName, labels.JSON(), value, time.Now().UTC())
+		})
 	} else if metricType == "gauge" {
 		value, err := strconv.ParseFloat(metricValue, 64)
 		if err != nil {
 			return fmt.Errorf("can't parse value to gauge type (float64), error: %s", err)
 		}
-		_, err = db.Conn.Exec(context.Background(),
-			`INSERT INTO gaugeMetrics (name, value, timestamp)
-                 VALUES ($1, $2, $3)
-                 ON CONFLICT (name) DO UPDATE SET value = $2, timestamp = $3;`,
-			metricName, value, time.Now())
-		if err != nil {
-			return err
-		}
+		return db.withReconnect(ctx, writePolicy, func() error {
+			return db.exec(ctx, upsertGauge, metricName, labels.JSON(), value, time.Now().UTC())
+		})
 	} else {
 		return fmt.Errorf("don't know such type: %s", metricType)
 	}
+}
 
-	return nil
+// SetMetrics Применяет пачку метрик одной транзакцией: либо записываются все метрики, либо ни одной
+func (db *Database) SetMetrics(ctx context.Context, metrics []storage.Metric) error {
+	gauges, counters, err := aggregateBatch(metrics)
+	if err != nil {
+		return err
+	}
+
+	return db.withReconnect(ctx, writePolicy, func() error {
+		return db.setMetricsTx(ctx, gauges, counters, false)
+	})
+}
+
+// Reset Удаляет все метрики из БД
+func (db *Database) Reset(ctx context.Context) error {
+	return db.ReplaceMetrics(ctx, nil)
+}
+
+// ReplaceMetrics Заменяет всё содержимое БД переданным снимком метрик одной транзакцией
+func (db *Database) ReplaceMetrics(ctx context.Context, metrics []storage.Metric) error {
+	gauges, counters, err := aggregateBatch(metrics)
+	if err != nil {
+		return err
+	}
+
+	return db.withReconnect(ctx, writePolicy, func() error {
+		return db.setMetricsTx(ctx, gauges, counters, true)
+	})
+}
+
+func (db *Database) setMetricsTx(ctx context.Context, gauges []gaugeRow, counters []counterRow, clear bool) error {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if clear {
+		if _, err = tx.Exec(ctx, clearGauge); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, clearCounter); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, clearSamples); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, clearRollups); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	batch := &pgx.Batch{}
+
+	for _, g := range gauges {
+		batch.Queue(upsertGauge, g.name, g.labels.JSON(), g.value, now)
+	}
+	for _, c := range counters {
+		batch.Queue(upsertCounter, c.name, c.labels.JSON(), c.value, now)
+	}
+
+	if err = tx.SendBatch(ctx, batch).Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
-func (db Database) GetMetricDB(metricType, metricName string) (string, error) {
+type gaugeRow struct {
+	name   string
+	labels storage.Labels
+	value  float64
+}
+
+type counterRow struct {
+	name   string
+	labels storage.Labels
+	value  int64
+}
+
+// aggregateBatch Проверяет значения пачки и схлопывает дубликаты одного ряда (имя и метки):
+// для counter дельты суммируются, для gauge остаётся последнее значение.
+// Ряды возвращаются отсортированными, чтобы параллельные пачки блокировали строки в одном порядке и не ловили deadlock
+func aggregateBatch(metrics []storage.Metric) ([]gaugeRow, []counterRow, error) {
+	gauges := make(map[string]*gaugeRow)
+	counters := make(map[string]*counterRow)
+
+	for _, m := range metrics {
+		key := storage.SeriesKey(m.ID, m.Labels)
+		if m.MType == "counter" {
+			value, err := strconv.ParseInt(m.Value, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("can't parse value of %s to counter type (int64), error: %s", key, err)
+			}
+			if c, ok := counters[key]; ok {
+				c.value += value
+			} else {
+				counters[key] = &counterRow{name: m.ID, labels: m.Labels, value: value}
+			}
+		} else if m.MType == "gauge" {
+			value, err := strconv.ParseFloat(m.Value, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("can't parse value of %s to gauge type (float64), error: %s", key, err)
+			}
+			gauges[key] = &gaugeRow{name: m.ID, labels: m.Labels, value: value}
+		} else {
+			return nil, nil, fmt.Errorf("don't know such type: %s", m.MType)
+		}
+	}
+
+	gaugeRows := make([]gaugeRow, 0, len(gauges))
+	for _, key := range sortedKeys(gauges) {
+		gaugeRows = append(gaugeRows, *gauges[key])
+	}
+	counterRows := make([]counterRow, 0, len(counters))
+	for _, key := range sortedKeys(counters) {
+		counterRows = append(counterRows, *counters[key])
+	}
+
+	return gaugeRows, counterRows, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (db *Database) GetMetric(ctx context.Context, metricType, metricName string, labels storage.Labels) (string, error) {
 
 	var metricValue string
+	var query string
 
 	if metricType == "counter" {
-		counterValue := db.Conn.QueryRow(context.Background(),
-			`SELECT value FROM counterMetrics WHERE name = $1`, metricName)
-		err := counterValue.Scan(&metricValue)
-		if err != nil {
-			return "", err
-		}
+		query = `SELECT value FROM counterMetrics WHERE name = $1 AND labels = $2::jsonb`
 	} else if metricType == "gauge" {
-		gaugeValue := db.Conn.QueryRow(context.Background(),
-			`SELECT value FROM gaugeMetrics WHERE name = $1`, metricName)
-		err := gaugeValue.Scan(&metricValue)
-		if err != nil {
-			return "", err
-		}
+		query = `SELECT value FROM gaugeMetrics WHERE name = $1 AND labels = $2::jsonb`
 	} else {
 		return "", fmt.Errorf("don't have metric's type %s in database", metricType)
 	}
 
+	err := db.withReconnect(ctx, readPolicy, func() error {
+		return db.Pool.QueryRow(ctx, query, metricName, labels.JSON()).Scan(&metricValue)
+	})
+	if err != nil {
+		return "", err
+	}
+
 	return metricValue, nil
 }
 
-func (db Database) GetExistsMetricsDB() (map[string]string, error) {
-
-	var metrics Metrics
-	var count int
+func (db *Database) GetExistsMetrics(ctx context.Context) (map[string]string, error) {
 
-	rows := db.Conn.QueryRow(context.Background(), getCount)
-	err := rows.Scan(&count)
+	metrics, err := db.ListMetrics(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	if count != 0 {
-		metricsList := make(map[string]string, count)
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("no metrics in storage for now")
+	}
 
-		rowsGauge, errQG := db.Conn.Query(context.Background(), `SELECT name, value FROM gaugeMetrics`)
-		if errQG != nil {
-			return nil, errQG
-		}
+	metricsList := make(map[string]string, len(metrics))
+	for _, m := range metrics {
+		metricsList[storage.SeriesKey(m.ID, m.Labels)] = m.Value
+	}
 
-		for rowsGauge.Next() {
-			errGScan := rowsGauge.Scan(&metrics.metricName, &metrics.metricValue)
-			if errGScan != nil {
-				return nil, errGScan
-			}
-			metricsList[metrics.metricName] = metrics.metricValue
-		}
+	return metricsList, nil
+}
 
-		rowsCounter, errCG := db.Conn.Query(context.Background(), `SELECT name, value FROM counterMetrics`)
-		if errCG != nil {
-			return nil, errCG
-		}
+func (db *Database) ListMetrics(ctx context.Context) ([]storage.Metric, error) {
 
-		for rowsCounter.Next() {
-			errCScan := rowsCounter.Scan(&metrics.metricName, &metrics.metricValue)
-			if errCScan != nil {
-				return nil, errCScan
-			}
-			metricsList[metrics.metricName] = metrics.metricValue
+	var metrics []storage.Metric
+
+	err := db.withReconnect(ctx, readPolicy, func() error {
+		rows, err := db.Pool.Query(ctx, listMetrics)
+		if err != nil {
+			return err
 		}
-		return metricsList, nil
+		metrics, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (storage.Metric, error) {
+			var m storage.Metric
+			err := row.Scan(&m.MType, &m.ID, &m.Labels, &m.Value)
+			return m, err
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+}
+
+func (db *Database) DeleteMetric(ctx context.Context, metricType, metricName string, labels storage.Labels) error {
+	var query string
+	if metricType == "counter" {
+		query = `DELETE FROM counterMetrics WHERE name = $1 AND labels = $2::jsonb`
+	} else if metricType == "gauge" {
+		query = `DELETE FROM gaugeMetrics WHERE name = $1 AND labels = $2::jsonb`
 	} else {
-		return nil, fmt.Errorf("no metrics in storage for now")
+		return fmt.Errorf("don't have such metric %s of type %s", metricName, metricType)
 	}
+	return db.withReconnect(ctx, writePolicy, func() error {
+		tx, err := db.begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		if _, err = tx.Exec(ctx, query, metricName, labels.JSON()); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, `DELETE FROM metricSamples WHERE type = $1 AND name = $2 AND labels = $3::jsonb`,
+			metricType, metricName, labels.JSON()); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, `DELETE FROM metricRollups WHERE type = $1 AND name = $2 AND labels = $3::jsonb`,
+			metricType, metricName, labels.JSON()); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
 }
@@ -1,9 +1,15 @@
 package db
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
+	"net"
 	"testing"
 )
 
@@ -30,7 +36,7 @@ func TestMemStorage_SetMetricDB(t *testing.T) {
 	}{
 		{
 			testName: "Add gauge metric",
-			db:       CreateDB(fmt.Sprintf("postgres://%s:%s@%s:%s/%s", user, pass, url, port, db)),
+			db:       CreateDB(fmt.Sprintf("postgres://%s:%s@%s:%s/%s", user, pass, url, port, db), 2),
 			dataMetric: metric{
 				metricName:  "testGauge",
 				metricType:  "gauge",
@@ -44,7 +50,7 @@ func TestMemStorage_SetMetricDB(t *testing.T) {
 		},
 		{
 			testName: "Add counter metric",
-			db:       CreateDB(fmt.Sprintf("postgres://%s:%s@%s:%s/%s", user, pass, url, port, db)),
+			db:       CreateDB(fmt.Sprintf("postgres://%s:%s@%s:%s/%s", user, pass, url, port, db), 2),
 			dataMetric: metric{
 				metricName:  "testCounter",
 				metricType:  "counter",
@@ -60,11 +66,66 @@ func TestMemStorage_SetMetricDB(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.testName, func(t *testing.T) {
-			err := tt.db.SetMetricDB(tt.dataMetric.metricType, tt.dataMetric.metricName, tt.dataMetric.metricValue)
+			err := tt.db.SetMetric(context.Background(), tt.dataMetric.metricType, tt.dataMetric.metricName, nil, tt.dataMetric.metricValue)
 			require.NoError(t, err)
-			metricG, errDB := tt.db.GetMetricDB(tt.dataMetric.metricType, tt.dataMetric.metricName)
+			metricG, errDB := tt.db.GetMetric(context.Background(), tt.dataMetric.metricType, tt.dataMetric.metricName, nil)
 			require.NoError(t, errDB)
 			assert.Equal(t, tt.wants.metricValue, metricG)
 		})
 	}
 }
+
+func TestAggregateBatch(t *testing.T) {
+	batch := []storage.Metric{
+		{MType: "counter", ID: "PollCount", Value: "2"},
+		{MType: "gauge", ID: "Alloc", Value: "1.5"},
+		{MType: "counter", ID: "PollCount", Value: "3"},
+		{MType: "gauge", ID: "Alloc", Value: "2.5"},
+		{MType: "gauge", ID: "Alloc", Labels: storage.Labels{"host": "a"}, Value: "7"},
+	}
+
+	gauges, counters, err := aggregateBatch(batch)
+	require.NoError(t, err)
+	assert.Equal(t, []gaugeRow{
+		{name: "Alloc", value: 2.5},
+		{name: "Alloc", labels: storage.Labels{"host": "a"}, value: 7},
+	}, gauges)
+	assert.Equal(t, []counterRow{{name: "PollCount", value: 5}}, counters)
+
+	_, _, err = aggregateBatch(append(batch, storage.Metric{MType: "counter", ID: "PollCount", Value: "bad"}))
+	assert.Error(t, err)
+}
+
+func TestIsSafeToRetry(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	assert.True(t, isSafeToRetry(&notSentError{err: reset}))
+	assert.False(t, isSafeToRetry(&notSentError{err: errors.New("permission denied")}))
+	// Обрыв во время записи: запрос мог выполниться, повторять нельзя
+	assert.False(t, isSafeToRetry(reset))
+	assert.False(t, isSafeToRetry(io.ErrUnexpectedEOF))
+	assert.True(t, isConnectionError(reset))
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationsFS)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version)
+		assert.NotEmpty(t, m.query)
+	}
+}
+
+func TestSetMetricsTx_NotConnected(t *testing.T) {
+	// Порт 1 закрыт: транзакция не начнётся, и запись можно повторить
+	pool, err := pgxpool.New(context.Background(), "postgres://u:p@127.0.0.1:1/db?connect_timeout=1")
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+	database := &Database{Pool: pool}
+
+	err = database.setMetricsTx(context.Background(), []gaugeRow{}, []counterRow{}, false)
+	var notSent *notSentError
+	require.ErrorAs(t, err, &notSent)
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+const (
+	minuteResolution = 60
+	hourResolution   = 3600
+)
+
+const (
+	// getRange Сырые значения отдаются как агрегаты из одного значения, чтобы сводить их вместе со свёрнутыми
+	getRange = `SELECT timestamp, min, max, sum, count, last FROM metricRollups
+        WHERE type = $1 AND name = $2 AND labels = $5::jsonb AND timestamp BETWEEN $3 AND $4
+        UNION ALL
+        SELECT timestamp, value, value, value, 1, value FROM metricSamples
+        WHERE type = $1 AND name = $2 AND labels = $5::jsonb AND timestamp BETWEEN $3 AND $4
+        ORDER BY timestamp`
+	rollupSamples = `INSERT INTO metricRollups (type, name, labels, resolution, timestamp, min, max, sum, count, last)
+        SELECT type, name, labels, $2, date_trunc('minute', timestamp),
+               MIN(value), MAX(value), SUM(value), COUNT(*), (array_agg(value ORDER BY timestamp DESC))[1]
+        FROM metricSamples WHERE timestamp < $1
+        GROUP BY type, name, labels, date_trunc('minute', timestamp)
+        ON CONFLICT (type, name, labels, resolution, timestamp) DO UPDATE SET
+            min = LEAST(metricRollups.min, EXCLUDED.min),
+            max = GREATEST(metricRollups.max, EXCLUDED.max),
+            sum = metricRollups.sum + EXCLUDED.sum,
+            count = metricRollups.count + EXCLUDED.count,
+            last = EXCLUDED.last`
+	deleteSamples = `DELETE FROM metricSamples WHERE timestamp < $1`
+	rollupMinutes = `INSERT INTO metricRollups (type, name, labels, resolution, timestamp, min, max, sum, count, last)
+        SELECT type, name, labels, $3, date_trunc('hour', timestamp),
+               MIN(min), MAX(max), SUM(sum), SUM(count)::bigint, (array_agg(last ORDER BY timestamp DESC))[1]
+        FROM metricRollups WHERE resolution = $2 AND timestamp < $1
+        GROUP BY type, name, labels, date_trunc('hour', timestamp)
+        ON CONFLICT (type, name, labels, resolution, timestamp) DO UPDATE SET
+            min = LEAST(metricRollups.min, EXCLUDED.min),
+            max = GREATEST(metricRollups.max, EXCLUDED.max),
+            sum = metricRollups.sum + EXCLUDED.sum,
+            count = metricRollups.count + EXCLUDED.count,
+            last = EXCLUDED.last`
+	deleteRollups = `DELETE FROM metricRollups WHERE resolution = $2 AND timestamp < $1`
+)
+
+func (db *Database) GetRange(ctx context.Context, q storage.RangeQuery) ([]storage.Sample, error) {
+	if q.MType != "counter" && q.MType != "gauge" {
+		return nil, fmt.Errorf("don't have metric's type %s in database", q.MType)
+	}
+
+	var rollups []storage.Rollup
+
+	err := db.withReconnect(ctx, readPolicy, func() error {
+		rows, err := db.Pool.Query(ctx, getRange, q.MType, q.ID, q.From.UTC(), q.To.UTC(), q.Labels.JSON())
+		if err != nil {
+			return err
+		}
+		rollups, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (storage.Rollup, error) {
+			var r storage.Rollup
+			err := row.Scan(&r.Timestamp, &r.Min, &r.Max, &r.Sum, &r.Count, &r.Last)
+			return r, err
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.ApplyStep(rollups, q), nil
+}
+
+// Compact Сворачивает устаревшие сырые значения в минутные агрегаты, минутные - в часовые
+// и удаляет часовые агрегаты старше политики хранения, всё одной транзакцией
+func (db *Database) Compact(ctx context.Context, policy storage.RetentionPolicy, now time.Time) error {
+	return db.withReconnect(ctx, writePolicy, func() error {
+		tx, err := db.begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		rawCutoff := now.Add(-policy.Raw).UTC()
+		if _, err = tx.Exec(ctx, rollupSamples, rawCutoff, minuteResolution); err != nil {
+			return fmt.Errorf("can't roll up raw samples, err: %s", err)
+		}
+		if _, err = tx.Exec(ctx, deleteSamples, rawCutoff); err != nil {
+			return err
+		}
+
+		minuteCutoff := now.Add(-policy.Minute).UTC()
+		if _, err = tx.Exec(ctx, rollupMinutes, minuteCutoff, minuteResolution, hourResolution); err != nil {
+			return fmt.Errorf("can't roll up minute rollups, err: %s", err)
+		}
+		if _, err = tx.Exec(ctx, deleteRollups, minuteCutoff, minuteResolution); err != nil {
+			return err
+		}
+
+		if policy.Hourly > 0 {
+			if _, err = tx.Exec(ctx, deleteRollups, now.Add(-policy.Hourly).UTC(), hourResolution); err != nil {
+				return err
+			}
+		}
+
+		return tx.Commit(ctx)
+	})
+}
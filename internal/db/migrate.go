@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.up.sql
+var migrationsFS embed.FS
+
+// migrationLockID Ключ advisory lock, чтобы несколько серверов не мигрировали схему одновременно
+const migrationLockID = 7_355_608
+
+const (
+	createSchemaVersion = `CREATE TABLE IF NOT EXISTS schema_version(
+        version    integer PRIMARY KEY,
+        name       text NOT NULL,
+        applied_at timestamp NOT NULL DEFAULT now())`
+	getSchemaVersion = `SELECT COALESCE(MAX(version), 0) FROM schema_version`
+	setSchemaVersion = `INSERT INTO schema_version (version, name) VALUES ($1, $2)`
+)
+
+type migration struct {
+	version int
+	name    string
+	query   string
+}
+
+// loadMigrations Читает встроенные миграции вида 0001_name.up.sql и сортирует их по версии
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	files, err := fs.Glob(fsys, "migrations/*.up.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]migration, 0, len(files))
+	versions := make(map[int]string, len(files))
+
+	for _, file := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(file, "migrations/"), ".up.sql")
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s must be named as <version>_<name>.up.sql", file)
+		}
+		version, errVersion := strconv.Atoi(prefix)
+		if errVersion != nil || version <= 0 {
+			return nil, fmt.Errorf("can't parse version of migration %s", file)
+		}
+		if other, exists := versions[version]; exists {
+			return nil, fmt.Errorf("migrations %s and %s have the same version %d", other, file, version)
+		}
+		versions[version] = file
+
+		query, errRead := fs.ReadFile(fsys, file)
+		if errRead != nil {
+			return nil, errRead
+		}
+
+		migrations = append(migrations, migration{
+			version: version,
+			name:    name,
+			query:   string(query),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
+
+// Migrate Применяет новые миграции схемы под advisory lock, каждую в своей транзакции
+func (db *Database) Migrate(ctx context.Context) error {
+	migrations, err := loadMigrations(migrationsFS)
+	if err != nil {
+		return err
+	}
+
+	conn, err := db.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("can't take migration lock, err: %s", err)
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	if _, err = conn.Exec(ctx, createSchemaVersion); err != nil {
+		return fmt.Errorf("can't create schema_version table, err: %s", err)
+	}
+
+	var current int
+	if err = conn.QueryRow(ctx, getSchemaVersion).Scan(&current); err != nil {
+		return fmt.Errorf("can't get schema version, err: %s", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, errTx := conn.Begin(ctx)
+		if errTx != nil {
+			return errTx
+		}
+
+		if _, errExec := tx.Exec(ctx, m.query); errExec != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("can't apply migration %s, err: %s", m.name, errExec)
+		}
+
+		if _, errExec := tx.Exec(ctx, setSchemaVersion, m.version, m.name); errExec != nil {
+			tx.Rollback(ctx)
+			return fmt.Errorf("can't save version of migration %s, err: %s", m.name, errExec)
+		}
+
+		if errCommit := tx.Commit(ctx); errCommit != nil {
+			return errCommit
+		}
+
+		log.Printf("applied migration %s", m.name)
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS gaugeMetrics(
+    id        serial PRIMARY KEY,
+    name      text NOT NULL,
+    value     double precision NOT NULL,
+    timestamp timestamp,
+    UNIQUE (name));
+
+CREATE TABLE IF NOT EXISTS counterMetrics(
+    id        serial PRIMARY KEY,
+    name      text NOT NULL,
+    value     bigint NOT NULL,
+    timestamp timestamp,
+    UNIQUE (name));
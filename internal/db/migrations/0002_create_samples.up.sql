@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS metricSamples(
+    id        bigserial PRIMARY KEY,
+    type      text NOT NULL,
+    name      text NOT NULL,
+    value     double precision NOT NULL,
+    timestamp timestamp NOT NULL);
+
+CREATE INDEX IF NOT EXISTS metricSamples_series_idx ON metricSamples (type, name, timestamp);
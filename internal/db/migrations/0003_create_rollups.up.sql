@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS metricRollups(
+    type       text NOT NULL,
+    name       text NOT NULL,
+    resolution integer NOT NULL,
+    timestamp  timestamp NOT NULL,
+    min        double precision NOT NULL,
+    max        double precision NOT NULL,
+    sum        double precision NOT NULL,
+    count      bigint NOT NULL,
+    last       double precision NOT NULL,
+    PRIMARY KEY (type, name, resolution, timestamp));
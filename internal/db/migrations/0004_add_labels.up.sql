@@ -0,0 +1,15 @@
+ALTER TABLE gaugeMetrics ADD COLUMN IF NOT EXISTS labels jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE gaugeMetrics DROP CONSTRAINT IF EXISTS gaugemetrics_name_key;
+ALTER TABLE gaugeMetrics ADD CONSTRAINT gaugemetrics_name_labels_key UNIQUE (name, labels);
+
+ALTER TABLE counterMetrics ADD COLUMN IF NOT EXISTS labels jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE counterMetrics DROP CONSTRAINT IF EXISTS countermetrics_name_key;
+ALTER TABLE counterMetrics ADD CONSTRAINT countermetrics_name_labels_key UNIQUE (name, labels);
+
+ALTER TABLE metricSamples ADD COLUMN IF NOT EXISTS labels jsonb NOT NULL DEFAULT '{}';
+DROP INDEX IF EXISTS metricSamples_series_idx;
+CREATE INDEX IF NOT EXISTS metricSamples_series_idx ON metricSamples (type, name, labels, timestamp);
+
+ALTER TABLE metricRollups ADD COLUMN IF NOT EXISTS labels jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE metricRollups DROP CONSTRAINT IF EXISTS metricrollups_pkey;
+ALTER TABLE metricRollups ADD PRIMARY KEY (type, name, labels, resolution, timestamp);
@@ -0,0 +1,209 @@
+package filestorage
+
+import (
+	"bufio"
+	"context"
+	"github.com/CvitoyBamp/metricsexporter/internal/json"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileStorage In-memory хранилище с сохранением метрик в файл
+type FileStorage struct {
+	*storage.MemStorage
+	FilePath      string
+	StoreInterval int
+	// fileMu Не даёт периодическому и финальному сохранению писать в файл одновременно
+	fileMu sync.Mutex
+}
+
+type Consumer struct {
+	file   *os.File
+	reader *bufio.Reader
+}
+
+type Producer struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func CreateFileStorage(filePath string, storeInterval, historySize int) *FileStorage {
+	return &FileStorage{
+		MemStorage:    storage.CreateMemStorageWithHistory(historySize),
+		FilePath:      filePath,
+		StoreInterval: storeInterval,
+	}
+}
+
+func (fs *FileStorage) SetMetric(ctx context.Context, metricType, metricName string, labels storage.Labels, metricValue string) error {
+	err := fs.MemStorage.SetMetric(ctx, metricType, metricName, labels, metricValue)
+	if err != nil {
+		return err
+	}
+	if fs.StoreInterval == 0 {
+		fs.SyncSavingToFile()
+	}
+	return nil
+}
+
+func (fs *FileStorage) SetMetrics(ctx context.Context, metrics []storage.Metric) error {
+	err := fs.MemStorage.SetMetrics(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	if fs.StoreInterval == 0 {
+		fs.SyncSavingToFile()
+	}
+	return nil
+}
+
+// Close Сохраняет последний снимок метрик в файл
+func (fs *FileStorage) Close() error {
+	return fs.save(true)
+}
+
+// save Перезаписывает файл текущим снимком метрик, sync - дождаться записи на диск
+func (fs *FileStorage) save(sync bool) error {
+	fs.fileMu.Lock()
+	defer fs.fileMu.Unlock()
+
+	producer, err := fs.newProducer(sync)
+	if err != nil {
+		return err
+	}
+	defer producer.file.Close()
+	return producer.saveToFile(fs.MemStorage)
+}
+
+func (fs *FileStorage) PreloadMetrics() error {
+	consumer, err := fs.newConsumer()
+	if err != nil {
+		return err
+	}
+	defer consumer.file.Close()
+	errRead := consumer.readFromFile(fs.MemStorage)
+	if errRead != nil {
+		return errRead
+	}
+	return nil
+}
+
+// LoadSnapshot Читает снимок метрик из файла, не изменяя сам файл
+func LoadSnapshot(filePath string) ([]storage.Metric, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ms := storage.CreateMemStorage()
+	consumer := &Consumer{
+		file:   file,
+		reader: bufio.NewReader(file),
+	}
+	if err = consumer.readFromFile(ms); err != nil {
+		return nil, err
+	}
+
+	return ms.Snapshot(), nil
+}
+
+// PostSaveMetrics Сохраняет метрики в файл раз в StoreInterval секунд, пока не отменён ctx.
+// Финальный снимок при остановке пишет Close
+func (fs *FileStorage) PostSaveMetrics(ctx context.Context) {
+
+	sI := time.NewTicker(time.Duration(fs.StoreInterval) * time.Second)
+	defer sI.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sI.C:
+			if err := fs.save(false); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+func (fs *FileStorage) SyncSavingToFile() {
+	if err := fs.save(true); err != nil {
+		log.Print(err)
+	}
+}
+
+func (fs *FileStorage) newProducer(sync bool) (*Producer, error) {
+
+	var file *os.File
+	var err error
+
+	if sync {
+		file, err = os.OpenFile(fs.FilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_SYNC, 0666)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		file, err = os.OpenFile(fs.FilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Producer{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+func (fs *FileStorage) newConsumer() (*Consumer, error) {
+	file, err := os.OpenFile(fs.FilePath, os.O_RDONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Consumer{
+		file:   file,
+		reader: bufio.NewReader(file),
+	}, nil
+}
+
+func (p *Producer) saveToFile(ms *storage.MemStorage) error {
+	data, errData := json.MetricConverter(ms)
+
+	if errData != nil {
+		return errData
+	}
+
+	if _, errWrite := p.writer.Write(data); errWrite != nil {
+		return errWrite
+	}
+
+	if err := p.writer.WriteByte('\n'); err != nil {
+		return err
+	}
+
+	log.Print("put the metrics in a file")
+
+	return p.writer.Flush()
+}
+
+func (c *Consumer) readFromFile(ms *storage.MemStorage) error {
+
+	data, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+
+	errJSON := json.Decoder(data, ms)
+	if errJSON != nil {
+		return errJSON
+	}
+
+	log.Print("i've read metrics from file")
+
+	return nil
+}
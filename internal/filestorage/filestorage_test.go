@@ -0,0 +1,29 @@
+package filestorage
+
+import (
+	"context"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStorage_SyncSaving(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics-db.json")
+
+	fs := CreateFileStorage(path, 0, 10)
+	require.NoError(t, fs.SetMetric(context.Background(), "gauge", "testGauge", nil, "1.5"))
+	require.NoError(t, fs.SetMetric(context.Background(), "counter", "testCounter", storage.Labels{"host": "a"}, "3"))
+
+	restored := CreateFileStorage(path, 0, 10)
+	require.NoError(t, restored.PreloadMetrics())
+
+	val, err := restored.GetMetric(context.Background(), "gauge", "testGauge", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "1.5", val)
+
+	val, err = restored.GetMetric(context.Background(), "counter", "testCounter", storage.Labels{"host": "a"})
+	require.NoError(t, err)
+	assert.Equal(t, "3", val)
+}
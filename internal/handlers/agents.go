@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"github.com/CvitoyBamp/metricsexporter/internal/json"
+	"net/http"
+)
+
+// getAgentsHandler Отдаёт реестр агентов с временем первого и последнего обращения: GET /api/v1/agents
+func (s *CustomServer) getAgentsHandler() http.Handler {
+	fn := func(res http.ResponseWriter, req *http.Request) {
+		if s.Agents == nil {
+			http.Error(res, "Registry of agents is disabled", http.StatusNotFound)
+			return
+		}
+
+		resp, err := json.AgentsCreator(s.Agents.List())
+		if err != nil {
+			http.Error(res, "can't create json", http.StatusInternalServerError)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		res.Write(resp)
+	}
+	return http.HandlerFunc(fn)
+}
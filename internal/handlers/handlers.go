@@ -2,8 +2,12 @@ package handlers
 
 import (
 	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/crypt"
 	"github.com/CvitoyBamp/metricsexporter/internal/json"
 	"github.com/CvitoyBamp/metricsexporter/internal/middlewares"
+	"github.com/CvitoyBamp/metricsexporter/internal/prometheus"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"github.com/CvitoyBamp/metricsexporter/internal/subnet"
 	"github.com/go-chi/chi/v5"
 	cors2 "github.com/go-chi/cors"
 	"html/template"
@@ -37,27 +41,39 @@ func (s *CustomServer) MetricRouter() chi.Router {
 	r := chi.NewRouter()
 	cors := cors2.New(cors2.Options{
 		AllowedMethods: []string{http.MethodPost, http.MethodGet},
-		AllowedHeaders: []string{"Content-Type", "Content-Encoding", "Accept-Encoding"},
+		AllowedHeaders: []string{"Content-Type", "Content-Encoding", "Accept-Encoding", middlewares.HashHeader, crypt.Header, subnet.Header},
 	})
 
 	r.Group(func(r chi.Router) {
 		r.Use(cors.Handler)
+		r.Use(middlewares.MiddlewareMaxBodySize(s.Config.MaxBodySize))
+		r.Use(middlewares.MiddlewareHash(s.Config.Key))
+		r.Use(middlewares.MiddlewareDecrypt(s.PrivateKey))
+		r.Use(middlewares.MiddlewareDecompress(s.Config.MaxBodySize))
 		r.Use(middlewares.MiddlewareZIP)
-		//r.Use(middleware.Compress(5, "application/json", "text/html; charset=UTF-8"))
 		r.Route("/", func(r chi.Router) {
 			r.Get("/", middlewares.Logging(s.getAllMetricsHandler()))
 			r.Get("/ping", s.checkDBConnectivityHandler)
+			r.Get("/metrics", middlewares.Logging(s.getPrometheusHandler()))
 			r.Route("/value", func(r chi.Router) {
 				r.Post("/", middlewares.Logging(s.getJSONMetricHandler()))
 				r.Get("/{metricType}/{metricName}", middlewares.Logging(s.getMetricValueHandler()))
 			})
 			r.Route("/update", func(r chi.Router) {
+				r.Use(middlewares.MiddlewareTrustedSubnet(s.TrustedSubnet))
 				r.Post("/", middlewares.Logging(s.createJSONMetricHandler()))
 				r.Post("/{metricType}/{metricName}/{metricValue}", middlewares.Logging(s.metricCreatorHandler()))
 			})
 			r.Route("/updates", func(r chi.Router) {
+				r.Use(middlewares.MiddlewareTrustedSubnet(s.TrustedSubnet))
 				r.Post("/", middlewares.Logging(s.createJSONMetricsHandler()))
 			})
+			r.Route("/api/v1", func(r chi.Router) {
+				r.Get("/range", middlewares.Logging(s.getRangeHandler()))
+				r.Get("/series", middlewares.Logging(s.getSeriesHandler()))
+				r.Get("/agents", middlewares.Logging(s.getAgentsHandler()))
+				r.Get("/admin/retention", middlewares.Logging(s.getRetentionHandler()))
+			})
 		})
 	})
 
@@ -65,18 +81,11 @@ func (s *CustomServer) MetricRouter() chi.Router {
 }
 
 func (s *CustomServer) getAllMetricsHandler() http.Handler {
-	fn := func(res http.ResponseWriter, _ *http.Request) {
+	fn := func(res http.ResponseWriter, req *http.Request) {
 		var metricList []MetricsList
 		var metric MetricsList
-		var list map[string]string
-		var err error
-
-		if s.Config.DSN != "" {
-			list, err = s.DB.GetExistsMetricsDB()
-		} else {
-			list, err = s.Storage.GetExistsMetrics()
-		}
 
+		list, err := s.Storage.GetExistsMetrics(req.Context())
 		if err != nil {
 			http.Error(res, "No metrics in storage", http.StatusNotFound)
 			return
@@ -113,7 +122,7 @@ func (s *CustomServer) getMetricValueHandler() http.Handler {
 	fn := func(res http.ResponseWriter, req *http.Request) {
 		metricType := chi.URLParam(req, "metricType")
 		metricName := chi.URLParam(req, "metricName")
-		s.GetMetric(metricType, metricName, res, req)
+		s.GetMetric(metricType, metricName, storage.ParseLabels(req.URL.Query()), res, req)
 		res.Header().Set("Content-Type", "text/plain")
 	}
 	return http.HandlerFunc(fn)
@@ -124,14 +133,13 @@ func (s *CustomServer) metricCreatorHandler() http.Handler {
 		metricType := chi.URLParam(req, "metricType")
 		metricName := chi.URLParam(req, "metricName")
 		metricValue := chi.URLParam(req, "metricValue")
-		err := s.CheckAndSetMetric(metricType, metricName, metricValue)
+		labels := storage.ParseLabels(req.URL.Query())
+		err := s.CheckAndSetMetric(req.Context(), metricType, metricName, labels, metricValue)
 		if err != nil {
 			http.Error(res, fmt.Sprintf("%s.", err), http.StatusBadRequest)
 			return
 		}
-		if s.Config.StoreInterval == 0 && s.Config.FilePath != "" && s.Config.DSN == "" {
-			s.SyncSavingToFile()
-		}
+		s.registerAgent(labels, req)
 		res.Header().Set("Content-Type", "text/plain")
 	}
 	return http.HandlerFunc(fn)
@@ -147,23 +155,21 @@ func (s *CustomServer) createJSONMetricHandler() http.Handler {
 			log.Println("Incorrect metric type, gauge or counter is expected.")
 			return
 		} else if data.MType == "gauge" {
-			err := s.CheckAndSetMetric(data.MType, data.ID, strconv.FormatFloat(*data.Value, 'f', -1, 64))
+			err := s.CheckAndSetMetric(req.Context(), data.MType, data.ID, data.Labels, strconv.FormatFloat(*data.Value, 'f', -1, 64))
 			if err != nil {
 				http.Error(res, fmt.Sprintf("%s.", err), http.StatusBadRequest)
 				log.Println("can't add metric to storage ", err)
 				return
 			}
 		} else if data.MType == "counter" {
-			err := s.CheckAndSetMetric(data.MType, data.ID, strconv.FormatInt(*data.Delta, 10))
+			err := s.CheckAndSetMetric(req.Context(), data.MType, data.ID, data.Labels, strconv.FormatInt(*data.Delta, 10))
 			if err != nil {
 				http.Error(res, fmt.Sprintf("%s.", err), http.StatusBadRequest)
 				log.Println("can't add metric to storage ", err)
 				return
 			}
 		}
-		if s.Config.StoreInterval == 0 && s.Config.FilePath != "" && s.Config.DSN == "" {
-			s.SyncSavingToFile()
-		}
+		s.registerAgent(data.Labels, req)
 		res.WriteHeader(http.StatusOK)
 		res.Header().Set("Content-Type", "application/json")
 		log.Printf("Metric %s of type %s was successfully added", data.ID, data.MType)
@@ -174,7 +180,7 @@ func (s *CustomServer) createJSONMetricHandler() http.Handler {
 func (s *CustomServer) getJSONMetricHandler() http.Handler {
 	fn := func(res http.ResponseWriter, req *http.Request) {
 		data := json.Parser(res, req)
-		s.GetMetric(data.MType, data.ID, res, req)
+		s.GetMetric(data.MType, data.ID, data.Labels, res, req)
 	}
 	return http.HandlerFunc(fn)
 }
@@ -184,36 +190,32 @@ func (s *CustomServer) createJSONMetricsHandler() http.Handler {
 
 		data := json.ListParser(res, req)
 
+		batch := make([]storage.Metric, 0, len(data))
 		for _, metric := range data {
-			if metric.MType != "gauge" && metric.MType != "counter" {
+			if metric.MType == "gauge" && metric.Value != nil {
+				batch = append(batch, storage.Metric{MType: metric.MType, ID: metric.ID, Labels: metric.Labels,
+					Value: strconv.FormatFloat(*metric.Value, 'f', -1, 64)})
+			} else if metric.MType == "counter" && metric.Delta != nil {
+				batch = append(batch, storage.Metric{MType: metric.MType, ID: metric.ID, Labels: metric.Labels,
+					Value: strconv.FormatInt(*metric.Delta, 10)})
+			} else {
 				e := fmt.Sprintf("Incorrect metric type, gauge or counter is expected, check %s metric type.", metric.ID)
 				http.Error(res, e, http.StatusBadRequest)
 				log.Println(e)
 				return
 			}
-
-			if metric.MType == "gauge" {
-				err := s.CheckAndSetMetric(metric.MType, metric.ID, strconv.FormatFloat(*metric.Value, 'f', -1, 64))
-				if err != nil {
-					http.Error(res, fmt.Sprintf("%s.", err), http.StatusBadRequest)
-					log.Println("can't add metric to storage ", err)
-					return
-				}
-			}
-
-			if metric.MType == "counter" {
-				err := s.CheckAndSetMetric(metric.MType, metric.ID, strconv.FormatInt(*metric.Delta, 10))
-				if err != nil {
-					http.Error(res, fmt.Sprintf("%s.", err), http.StatusBadRequest)
-					log.Println("can't add metric to storage ", err)
-					return
-				}
-			}
 		}
 
-		if s.Config.StoreInterval == 0 && s.Config.FilePath != "" && s.Config.DSN == "" {
-			s.SyncSavingToFile()
+		err := s.Storage.SetMetrics(req.Context(), batch)
+		if err != nil {
+			http.Error(res, fmt.Sprintf("%s.", err), http.StatusBadRequest)
+			log.Println("can't add metrics to storage ", err)
+			return
+		}
+		for _, metric := range batch {
+			s.registerAgent(metric.Labels, req)
 		}
+
 		res.WriteHeader(http.StatusOK)
 		res.Header().Set("Content-Type", "application/json")
 		log.Printf("Batch of metrics was added")
@@ -222,9 +224,31 @@ func (s *CustomServer) createJSONMetricsHandler() http.Handler {
 }
 
 func (s *CustomServer) checkDBConnectivityHandler(res http.ResponseWriter, req *http.Request) {
-	err := s.DB.CheckConnectivity()
+	err := s.Storage.Ping(req.Context())
 	if err != nil {
 		http.Error(res, fmt.Sprintf("%s", err), http.StatusInternalServerError)
+		return
 	}
 	res.WriteHeader(http.StatusOK)
 }
+
+// getPrometheusHandler Отдаёт все метрики хранилища в формате экспозиции Prometheus или OpenMetrics
+func (s *CustomServer) getPrometheusHandler() http.Handler {
+	fn := func(res http.ResponseWriter, req *http.Request) {
+		metrics, err := s.Storage.ListMetrics(req.Context())
+		if err != nil {
+			log.Printf("can't list metrics: %s", err)
+			http.Error(res, "can't list metrics", http.StatusInternalServerError)
+			return
+		}
+
+		contentType := prometheus.Negotiate(req.Header.Get("Accept"))
+		res.Header().Set("Content-Type", contentType)
+		res.WriteHeader(http.StatusOK)
+
+		if err = prometheus.Write(res, metrics, contentType); err != nil {
+			log.Printf("can't write metrics exposition: %s", err)
+		}
+	}
+	return http.HandlerFunc(fn)
+}
@@ -31,6 +31,7 @@ func TestMetricCreatorHandler(t *testing.T) {
 
 	s := &CustomServer{
 		Storage: storage.CreateMemStorage(),
+		Agents:  storage.CreateAgentRegistry(),
 		Config: &Config{
 			StoreInterval: 5,
 			FilePath:      "metrics-db.json",
@@ -125,6 +126,107 @@ func TestMetricCreatorHandler(t *testing.T) {
 				contentType: "text/plain; charset=utf-8",
 			},
 		},
+		{
+			testName: "Labeled metric was successfully added",
+			request: request{
+				url:    "/update/gauge/testGauge/7?label.host=a",
+				method: http.MethodPost,
+			},
+			wants: wants{
+				code:        http.StatusOK,
+				contentType: "text/plain",
+			},
+		},
+		{
+			testName: "Get labeled metric by Name",
+			request: request{
+				url:    "/value/gauge/testGauge?label.host=a",
+				method: http.MethodGet,
+			},
+			wants: wants{
+				code:        http.StatusOK,
+				contentType: "",
+				value:       "7",
+			},
+		},
+		{
+			testName: "Get all series of metric",
+			request: request{
+				url:    "/api/v1/series?name=testGauge",
+				method: http.MethodGet,
+			},
+			wants: wants{
+				code:        http.StatusOK,
+				contentType: "application/json",
+				value:       `[{"id":"testGauge","type":"gauge","value":100.1},{"id":"testGauge","type":"gauge","labels":{"host":"a"},"value":7}]`,
+			},
+		},
+		{
+			testName: "Get series of unexist metric",
+			request: request{
+				url:    "/api/v1/series?name=UnExistMetric",
+				method: http.MethodGet,
+			},
+			wants: wants{
+				code:        http.StatusNotFound,
+				contentType: "text/plain; charset=utf-8",
+			},
+		},
+		{
+			testName: "Metric of agent instance was successfully added",
+			request: request{
+				url:    "/update/counter/PollCount/1?label.instance=host-1",
+				method: http.MethodPost,
+			},
+			wants: wants{
+				code:        http.StatusOK,
+				contentType: "text/plain",
+			},
+		},
+		{
+			testName: "Get registry of agents",
+			request: request{
+				url:    "/api/v1/agents",
+				method: http.MethodGet,
+			},
+			wants: wants{
+				code:        http.StatusOK,
+				contentType: "application/json",
+			},
+		},
+		{
+			testName: "Get metric history",
+			request: request{
+				url:    "/api/v1/range?name=testGauge&type=gauge&step=1m",
+				method: http.MethodGet,
+			},
+			wants: wants{
+				code:        http.StatusOK,
+				contentType: "application/json",
+			},
+		},
+		{
+			testName: "Get history with incorrect type",
+			request: request{
+				url:    "/api/v1/range?name=testGauge&type=histogram",
+				method: http.MethodGet,
+			},
+			wants: wants{
+				code:        http.StatusBadRequest,
+				contentType: "text/plain; charset=utf-8",
+			},
+		},
+		{
+			testName: "Get metrics in Prometheus format",
+			request: request{
+				url:    "/metrics",
+				method: http.MethodGet,
+			},
+			wants: wants{
+				code:        http.StatusOK,
+				contentType: "text/plain; version=0.0.4; charset=utf-8",
+			},
+		},
 		{
 			testName: "Get metrics",
 			request: request{
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/json"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultRange Интервал, за который отдаётся история, если from не указан
+const defaultRange = time.Hour
+
+// getRangeHandler Отдаёт историю метрики: GET /api/v1/range?name=&type=&from=&to=&step=&agg=.
+// Ряд с метками выбирается параметрами label.<имя>=<значение>
+func (s *CustomServer) getRangeHandler() http.Handler {
+	fn := func(res http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		metricName := query.Get("name")
+		metricType := query.Get("type")
+
+		if metricName == "" {
+			http.Error(res, "Metric name is required.", http.StatusBadRequest)
+			return
+		}
+		if metricType != "gauge" && metricType != "counter" {
+			http.Error(res, "Incorrect metric type, gauge or counter is expected.", http.StatusBadRequest)
+			return
+		}
+
+		to, err := parseTime(query.Get("to"), time.Now())
+		if err != nil {
+			http.Error(res, fmt.Sprintf("Can't parse to: %s.", err), http.StatusBadRequest)
+			return
+		}
+		from, err := parseTime(query.Get("from"), to.Add(-defaultRange))
+		if err != nil {
+			http.Error(res, fmt.Sprintf("Can't parse from: %s.", err), http.StatusBadRequest)
+			return
+		}
+		if from.After(to) {
+			http.Error(res, "from must be before to.", http.StatusBadRequest)
+			return
+		}
+		step, err := parseStep(query.Get("step"))
+		if err != nil {
+			http.Error(res, fmt.Sprintf("Can't parse step: %s.", err), http.StatusBadRequest)
+			return
+		}
+
+		agg, err := storage.ParseAggregation(query.Get("agg"))
+		if err != nil {
+			http.Error(res, fmt.Sprintf("%s.", err), http.StatusBadRequest)
+			return
+		}
+
+		q := storage.RangeQuery{
+			MType:  metricType,
+			ID:     metricName,
+			Labels: storage.ParseLabels(query),
+			From:   from,
+			To:     to,
+			Step:   step,
+			Agg:    agg,
+		}
+
+		samples, err := s.Storage.GetRange(req.Context(), q)
+		if err != nil {
+			log.Printf("Can't get history of metric %s: %s", metricName, err)
+			http.Error(res, "No such metric in storage", http.StatusNotFound)
+			return
+		}
+
+		resp, err := json.SeriesCreator(q, samples)
+		if err != nil {
+			http.Error(res, "can't create json", http.StatusInternalServerError)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		res.Write(resp)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// getRetentionHandler Отдаёт политику хранения истории и состояние её последнего применения
+func (s *CustomServer) getRetentionHandler() http.Handler {
+	fn := func(res http.ResponseWriter, req *http.Request) {
+		if s.Compactor == nil {
+			http.Error(res, "Retention of metrics history is disabled", http.StatusNotFound)
+			return
+		}
+
+		lastRun, lastErr := s.Compactor.Status()
+		resp, err := json.RetentionCreator(s.Compactor.Policy, s.Compactor.Interval, lastRun, lastErr)
+		if err != nil {
+			http.Error(res, "can't create json", http.StatusInternalServerError)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		res.Write(resp)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// parseTime Принимает время в формате RFC3339 или unix timestamp в секундах
+func parseTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(sec*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseStep Принимает шаг как длительность Go (1m, 30s) или число секунд
+func parseStep(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if sec, err := strconv.ParseFloat(value, 64); err == nil {
+		if sec < 0 {
+			return 0, fmt.Errorf("step can't be negative")
+		}
+		return time.Duration(sec * float64(time.Second)), nil
+	}
+	step, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if step < 0 {
+		return 0, fmt.Errorf("step can't be negative")
+	}
+	return step, nil
+}
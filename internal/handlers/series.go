@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"github.com/CvitoyBamp/metricsexporter/internal/json"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// getSeriesHandler Отдаёт все ряды метрики с заданным именем: GET /api/v1/series?name=&type=.
+// Тип необязателен, без него возвращаются ряды обоих типов
+func (s *CustomServer) getSeriesHandler() http.Handler {
+	fn := func(res http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		metricName := query.Get("name")
+		metricType := query.Get("type")
+
+		if metricName == "" {
+			http.Error(res, "Metric name is required.", http.StatusBadRequest)
+			return
+		}
+		if metricType != "" && metricType != "gauge" && metricType != "counter" {
+			http.Error(res, "Incorrect metric type, gauge or counter is expected.", http.StatusBadRequest)
+			return
+		}
+
+		metrics, err := s.Storage.ListMetrics(req.Context())
+		if err != nil {
+			log.Printf("Can't list metrics: %s", err)
+			http.Error(res, "can't list metrics", http.StatusInternalServerError)
+			return
+		}
+
+		series := make([]storage.Metric, 0)
+		for _, m := range metrics {
+			if m.ID == metricName && (metricType == "" || m.MType == metricType) {
+				series = append(series, m)
+			}
+		}
+		if len(series) == 0 {
+			http.Error(res, "No such metric in storage", http.StatusNotFound)
+			return
+		}
+		sort.Slice(series, func(i, j int) bool {
+			if series[i].MType != series[j].MType {
+				return series[i].MType < series[j].MType
+			}
+			return series[i].Labels.String() < series[j].Labels.String()
+		})
+
+		resp, err := json.ListFromStorage(series)
+		if err != nil {
+			http.Error(res, "can't create json", http.StatusInternalServerError)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		res.Write(resp)
+	}
+	return http.HandlerFunc(fn)
+}
@@ -1,13 +1,14 @@
 package handlers
 
 import (
-	"bufio"
-	"github.com/CvitoyBamp/metricsexporter/internal/db"
-	"github.com/CvitoyBamp/metricsexporter/internal/json"
+	"context"
+	"crypto/rsa"
+	"fmt"
 	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"github.com/CvitoyBamp/metricsexporter/internal/tlsutil"
 	"log"
+	"net"
 	"net/http"
-	"os"
 	"time"
 )
 
@@ -16,140 +17,101 @@ type Config struct {
 	StoreInterval int    `env:"STORE_INTERVAL"`
 	FilePath      string `env:"FILE_STORAGE_PATH"`
 	Restore       bool   `env:"RESTORE"`
+	RestorePolicy string `env:"RESTORE_POLICY"`
 	DSN           string `env:"DATABASE_DSN"`
-}
+	DBMaxConns    int    `env:"DATABASE_MAX_CONNS"`
+	HistorySize   int    `env:"HISTORY_SIZE"`
 
-type Consumer struct {
-	file   *os.File
-	reader *bufio.Reader
-}
+	RetentionRaw    time.Duration `env:"RETENTION_RAW"`
+	RetentionMinute time.Duration `env:"RETENTION_MINUTE"`
+	RetentionHourly time.Duration `env:"RETENTION_HOURLY"`
+	CompactInterval time.Duration `env:"COMPACT_INTERVAL"`
 
-type Producer struct {
-	file   *os.File
-	writer *bufio.Writer
-}
+	Key       string `env:"KEY"`
+	CryptoKey string `env:"CRYPTO_KEY"`
 
-type CustomServer struct {
-	Server  *http.Server
-	Storage *storage.MemStorage
-	Config  *Config
-	DB      *db.Database
-}
+	TLSCert     string `env:"TLS_CERT"`
+	TLSKey      string `env:"TLS_KEY"`
+	TLSClientCA string `env:"TLS_CLIENT_CA"`
 
-func CreateServer(cfg Config) *CustomServer {
-	return &CustomServer{
-		Server:  &http.Server{},
-		Storage: storage.CreateMemStorage(),
-		Config:  &cfg,
-		DB:      db.CreateDB(cfg.DSN),
-	}
-}
+	TrustedSubnet string `env:"TRUSTED_SUBNET"`
+	GRPCAddress   string `env:"GRPC_ADDRESS"`
+	MaxBodySize   int64  `env:"MAX_BODY_SIZE"`
 
-func (s *CustomServer) PreloadMetrics() error {
-	consumer, err := s.newConsumer()
-	if err != nil {
-		return err
-	}
-	errRead := consumer.readFromFile(s.Storage)
-	if errRead != nil {
-		return errRead
-	}
-	return nil
-}
-
-func (s *CustomServer) RunServer() error {
-	return http.ListenAndServe(s.Config.Address, s.MetricRouter())
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
 }
 
-func (s *CustomServer) PostSaveMetrics() {
-
-	sI := time.NewTicker(time.Duration(s.Config.StoreInterval) * time.Second)
-
-	for {
-		<-sI.C
-		producer, errProducer := s.newProducer(false)
-		if errProducer != nil {
-			log.Print(errProducer)
-		}
-		errSave := producer.saveToFile(s.Storage)
-		if errProducer != nil {
-			log.Print(errSave)
-		}
+func (c Config) RetentionPolicy() storage.RetentionPolicy {
+	return storage.RetentionPolicy{
+		Raw:    c.RetentionRaw,
+		Minute: c.RetentionMinute,
+		Hourly: c.RetentionHourly,
 	}
 }
 
-func (s *CustomServer) StopServer() error {
-	return s.Server.Close()
+type CustomServer struct {
+	Server    *http.Server
+	Storage   storage.Repository
+	Config    *Config
+	Compactor *storage.Compactor
+	Agents    *storage.AgentRegistry
+	// PrivateKey Закрытый ключ для расшифровки тел запросов агентов, nil - запросы не шифруются
+	PrivateKey *rsa.PrivateKey
+	// TrustedSubnet Подсеть, из которой принимаются метрики, nil - ограничения нет
+	TrustedSubnet *net.IPNet
 }
 
-func (s *CustomServer) newProducer(sync bool) (*Producer, error) {
-
-	var file *os.File
-	var err error
-
-	if sync {
-		file, err = os.OpenFile(s.Config.FilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_SYNC, 0666)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		file, err = os.OpenFile(s.Config.FilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-		if err != nil {
-			return nil, err
-		}
+func CreateServer(cfg Config, repo storage.Repository) *CustomServer {
+	s := &CustomServer{
+		Server:  &http.Server{},
+		Storage: repo,
+		Config:  &cfg,
+		Agents:  storage.CreateAgentRegistry(),
 	}
 
-	return &Producer{
-		file:   file,
-		writer: bufio.NewWriter(file),
-	}, nil
-}
-
-func (s *CustomServer) newConsumer() (*Consumer, error) {
-	file, err := os.OpenFile(s.Config.FilePath, os.O_RDONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return nil, err
+	if cfg.CompactInterval > 0 {
+		s.Compactor = storage.CreateCompactor(repo, cfg.RetentionPolicy(), cfg.CompactInterval)
 	}
 
-	return &Consumer{
-		file:   file,
-		reader: bufio.NewReader(file),
-	}, nil
+	return s
 }
 
-func (p *Producer) saveToFile(ms *storage.MemStorage) error {
-	data, errData := json.MetricConverter(ms)
-
-	if errData != nil {
-		return errData
-	}
+// RunServer Запускает HTTP-сервер, а если заданы сертификат и ключ - HTTPS.
+// С TLSClientCA сервер принимает только клиентов с сертификатом, подписанным этим CA
+func (s *CustomServer) RunServer() error {
+	s.Server.Addr = s.Config.Address
+	s.Server.Handler = s.MetricRouter()
 
-	if _, errWrite := p.writer.Write(data); errWrite != nil {
-		return errWrite
+	if s.Config.TLSCert == "" && s.Config.TLSKey == "" {
+		if s.Config.TLSClientCA != "" {
+			return fmt.Errorf("client CA requires TLS certificate and key of the server")
+		}
+		return s.Server.ListenAndServe()
 	}
 
-	if err := p.writer.WriteByte('\n'); err != nil {
+	tlsConfig, err := tlsutil.ServerConfig(s.Config.TLSClientCA)
+	if err != nil {
 		return err
 	}
-
-	log.Print("put the metrics in a file")
-
-	return p.writer.Flush()
+	s.Server.TLSConfig = tlsConfig
+	return s.Server.ListenAndServeTLS(s.Config.TLSCert, s.Config.TLSKey)
 }
 
-func (c *Consumer) readFromFile(ms *storage.MemStorage) error {
+func (s *CustomServer) StopServer() error {
+	return s.Server.Close()
+}
 
-	data, err := c.reader.ReadBytes('\n')
-	if err != nil {
-		return err
+// Shutdown Дожидается завершения обрабатываемых запросов, но не дольше ctx, и закрывает хранилище:
+// файловое хранилище записывает финальный снимок, БД закрывает пул соединений
+func (s *CustomServer) Shutdown(ctx context.Context) error {
+	errShutdown := s.Server.Shutdown(ctx)
+	if errShutdown != nil {
+		log.Printf("can't drain HTTP connections, err: %s", errShutdown)
 	}
 
-	errJSON := json.Decoder(data, ms)
-	if errJSON != nil {
-		return errJSON
+	if err := s.Storage.Close(); err != nil {
+		return fmt.Errorf("can't close storage, err: %s", err)
 	}
 
-	log.Print("i've read metrics from file")
-
-	return nil
+	return errShutdown
 }
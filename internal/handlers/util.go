@@ -1,67 +1,56 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"github.com/CvitoyBamp/metricsexporter/internal/json"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
 	"io"
 	"log"
 	"net/http"
+	"time"
 )
 
-func (s *CustomServer) CheckAndSetMetric(metricType, metricName, metricValue string) error {
+func (s *CustomServer) CheckAndSetMetric(ctx context.Context, metricType, metricName string, labels storage.Labels, metricValue string) error {
 	// Проверка типа метрики (gauge или counter)
 	if metricType != "gauge" && metricType != "counter" {
 		log.Printf("Incorrect metric type recieved: %s", metricType)
 		return fmt.Errorf("incorrect metric type, gauge or counter is expected")
 	}
 
-	if s.Config.DSN != "" {
-		return s.DB.SetMetricDB(metricType, metricName, metricValue)
-	} else {
-		return s.Storage.SetMetric(metricType, metricName, metricValue)
-	}
+	return s.Storage.SetMetric(ctx, metricType, metricName, labels, metricValue)
 }
 
-func (s *CustomServer) GetMetric(metricType, metricName string, res http.ResponseWriter, req *http.Request) {
-
-	var err error
-	var metricValue string
-
-	if s.Config.DSN != "" {
-		metricValue, err = s.DB.GetMetricDB(metricType, metricName)
-	} else {
-		metricValue, err = s.Storage.GetMetric(metricType, metricName)
+// registerAgent Отмечает в реестре агента, чьей меткой instance помечена метрика
+func (s *CustomServer) registerAgent(labels storage.Labels, req *http.Request) {
+	if s.Agents == nil {
+		return
 	}
+	s.Agents.Seen(labels[storage.InstanceLabel], req.RemoteAddr, time.Now())
+}
 
+func (s *CustomServer) GetMetric(metricType, metricName string, labels storage.Labels, res http.ResponseWriter, req *http.Request) {
+
+	metricValue, err := s.Storage.GetMetric(req.Context(), metricType, metricName, labels)
 	if err != nil {
-		log.Printf("No such metric in storage: %s", metricName)
+		log.Printf("No such metric in storage: %s", storage.SeriesKey(metricName, labels))
 		http.Error(res, "No such metric in storage", http.StatusNotFound)
+		return
 	}
 
 	if req.Header.Get("Content-Type") == "application/json" {
-		resp, respErr := json.Creator(metricValue, metricType, metricName)
+		resp, respErr := json.Creator(metricValue, metricType, metricName, labels)
 		if respErr != nil {
 			http.Error(res, "can't parse data as json", http.StatusBadRequest)
+			return
 		}
 		res.Header().Set("Content-Type", "application/json")
 		res.WriteHeader(http.StatusOK)
 		res.Write(resp)
 	} else {
 		_, err = io.WriteString(res, metricValue)
-		res.WriteHeader(http.StatusOK)
 		if err != nil {
 			log.Println("can't write answer to response")
 		}
 	}
 }
-
-func (s *CustomServer) SyncSavingToFile() {
-	producer, errProducer := s.newProducer(true)
-	if errProducer != nil {
-		log.Print(errProducer)
-	}
-	errSave := producer.saveToFile(s.Storage)
-	if errProducer != nil {
-		log.Print(errSave)
-	}
-}
@@ -1,6 +1,7 @@
 package json
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/CvitoyBamp/metricsexporter/internal/storage"
@@ -8,13 +9,15 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Metrics struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	ID     string         `json:"id"`               // имя метрики
+	MType  string         `json:"type"`             // параметр, принимающий значение gauge или counter
+	Labels storage.Labels `json:"labels,omitempty"` // метки метрики, вместе с именем определяют ряд
+	Delta  *int64         `json:"delta,omitempty"`  // значение метрики в случае передачи counter
+	Value  *float64       `json:"value,omitempty"`  // значение метрики в случае передачи gauge
 }
 
 func Parser(res http.ResponseWriter, req *http.Request) *Metrics {
@@ -38,7 +41,7 @@ func Parser(res http.ResponseWriter, req *http.Request) *Metrics {
 	return &jsonStruct
 }
 
-func Creator(metricValue, metricType, metricName string) ([]byte, error) {
+func Creator(metricValue, metricType, metricName string, labels storage.Labels) ([]byte, error) {
 	var cData Metrics
 	var gData Metrics
 
@@ -49,9 +52,10 @@ func Creator(metricValue, metricType, metricName string) ([]byte, error) {
 		}
 
 		gData = Metrics{
-			ID:    metricName,
-			MType: metricType,
-			Value: &value,
+			ID:     metricName,
+			MType:  metricType,
+			Labels: labels,
+			Value:  &value,
 		}
 		return json.Marshal(gData)
 	}
@@ -62,41 +66,62 @@ func Creator(metricValue, metricType, metricName string) ([]byte, error) {
 			_ = fmt.Errorf("can't parse value to counter type (int64), error: %s", err)
 		}
 		cData = Metrics{
-			ID:    metricName,
-			MType: metricType,
-			Delta: &value,
+			ID:     metricName,
+			MType:  metricType,
+			Labels: labels,
+			Delta:  &value,
 		}
 		return json.Marshal(cData)
 	}
 	return nil, fmt.Errorf("can't parse metric type")
 }
 
-func MetricConverter(ms *storage.MemStorage) ([]byte, error) {
-
-	ms.RLock()
-	defer ms.RUnlock()
-
-	var arr []string
-	var metric Metrics
-
-	for k, v := range ms.GetGaugeMetrics() {
-		metric = Metrics{
-			ID:    k,
-			MType: "gauge",
-			Value: &v,
+// FromStorage Преобразует метрику хранилища в формат JSON
+func FromStorage(m storage.Metric) (Metrics, error) {
+	metric := Metrics{
+		ID:     m.ID,
+		MType:  m.MType,
+		Labels: m.Labels,
+	}
+	if m.MType == "gauge" {
+		value, err := strconv.ParseFloat(m.Value, 64)
+		if err != nil {
+			return metric, fmt.Errorf("can't parse value to gauge type (float64), error: %s", err)
 		}
-		data, err := json.Marshal(metric)
+		metric.Value = &value
+	} else if m.MType == "counter" {
+		value, err := strconv.ParseInt(m.Value, 10, 64)
+		if err != nil {
+			return metric, fmt.Errorf("can't parse value to counter type (int64), error: %s", err)
+		}
+		metric.Delta = &value
+	} else {
+		return metric, fmt.Errorf("can't parse metric type")
+	}
+	return metric, nil
+}
+
+// ListFromStorage Сериализует список метрик хранилища в JSON-массив
+func ListFromStorage(metrics []storage.Metric) ([]byte, error) {
+	list := make([]Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		metric, err := FromStorage(m)
 		if err != nil {
 			return nil, err
 		}
-		arr = append(arr, string(data))
+		list = append(list, metric)
 	}
+	return json.Marshal(list)
+}
+
+func MetricConverter(ms *storage.MemStorage) ([]byte, error) {
+
+	var arr []string
 
-	for k, v := range ms.GetCounterMetrics() {
-		metric = Metrics{
-			ID:    k,
-			MType: "counter",
-			Delta: &v,
+	for _, m := range ms.Snapshot() {
+		metric, err := FromStorage(m)
+		if err != nil {
+			return nil, err
 		}
 		data, err := json.Marshal(metric)
 		if err != nil {
@@ -119,13 +144,13 @@ func Decoder(data []byte, ms *storage.MemStorage) error {
 
 	for _, v := range jsonData {
 		if v.MType == "gauge" {
-			errSetG := ms.SetMetric(v.MType, v.ID, strconv.FormatFloat(*v.Value, 'f', -1, 64))
+			errSetG := ms.SetMetric(context.Background(), v.MType, v.ID, v.Labels, strconv.FormatFloat(*v.Value, 'f', -1, 64))
 			if errSetG != nil {
 				return errSetG
 			}
 		}
 		if v.MType == "counter" {
-			errSetC := ms.SetMetric(v.MType, v.ID, strconv.FormatInt(*v.Delta, 10))
+			errSetC := ms.SetMetric(context.Background(), v.MType, v.ID, v.Labels, strconv.FormatInt(*v.Delta, 10))
 			if errSetC != nil {
 				return errSetC
 			}
@@ -156,16 +181,17 @@ func ListParser(res http.ResponseWriter, req *http.Request) []Metrics {
 	return jsonStruct
 }
 
-func ListCreator(gm map[string]float64, cm map[string]int64) ([]byte, error) {
+func ListCreator(gm map[string]float64, cm map[string]int64, labels storage.Labels) ([]byte, error) {
 
 	var metrics Metrics
 	var metricsList []string
 
 	for k, v := range gm {
 		metrics = Metrics{
-			ID:    k,
-			MType: "gauge",
-			Value: &v,
+			ID:     k,
+			MType:  "gauge",
+			Labels: labels,
+			Value:  &v,
 		}
 		data, err := json.Marshal(metrics)
 		if err != nil {
@@ -176,9 +202,10 @@ func ListCreator(gm map[string]float64, cm map[string]int64) ([]byte, error) {
 
 	for k, v := range cm {
 		metrics = Metrics{
-			ID:    k,
-			MType: "counter",
-			Delta: &v,
+			ID:     k,
+			MType:  "counter",
+			Labels: labels,
+			Delta:  &v,
 		}
 		data, err := json.Marshal(metrics)
 		if err != nil {
@@ -191,3 +218,112 @@ func ListCreator(gm map[string]float64, cm map[string]int64) ([]byte, error) {
 
 	return []byte(output), nil
 }
+
+// Sample Значение метрики в момент времени
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// Series Ряд значений метрики за интервал времени
+type Series struct {
+	ID      string         `json:"id"`
+	MType   string         `json:"type"`
+	Labels  storage.Labels `json:"labels,omitempty"`
+	From    time.Time      `json:"from"`
+	To      time.Time      `json:"to"`
+	Step    string         `json:"step,omitempty"`
+	Agg     string         `json:"agg"`
+	Samples []Sample       `json:"samples"`
+}
+
+// ListDecoder Разбирает список метрик, созданный ListCreator, обратно в значения gauge и приращения counter
+func ListDecoder(data []byte) (map[string]float64, map[string]int64, error) {
+	var metrics []Metrics
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return nil, nil, err
+	}
+
+	gm := make(map[string]float64)
+	cm := make(map[string]int64)
+	for _, m := range metrics {
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+			gm[m.ID] = *m.Value
+		case m.MType == "counter" && m.Delta != nil:
+			cm[m.ID] += *m.Delta
+		default:
+			return nil, nil, fmt.Errorf("incorrect metric %s of type %s", m.ID, m.MType)
+		}
+	}
+	return gm, cm, nil
+}
+
+func SeriesCreator(q storage.RangeQuery, samples []storage.Sample) ([]byte, error) {
+	series := Series{
+		ID:      q.ID,
+		MType:   q.MType,
+		Labels:  q.Labels,
+		From:    q.From,
+		To:      q.To,
+		Agg:     string(q.Agg),
+		Samples: make([]Sample, 0, len(samples)),
+	}
+	if q.Step > 0 {
+		series.Step = q.Step.String()
+	}
+	for _, s := range samples {
+		series.Samples = append(series.Samples, Sample{Timestamp: s.Timestamp, Value: s.Value})
+	}
+	return json.Marshal(series)
+}
+
+// Agent Агент, присылавший метрики на сервер
+type Agent struct {
+	Instance  string    `json:"instance"`
+	Address   string    `json:"address"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func AgentsCreator(agents []storage.AgentInfo) ([]byte, error) {
+	list := make([]Agent, 0, len(agents))
+	for _, a := range agents {
+		list = append(list, Agent{
+			Instance:  a.Instance,
+			Address:   a.Address,
+			FirstSeen: a.FirstSeen,
+			LastSeen:  a.LastSeen,
+		})
+	}
+	return json.Marshal(list)
+}
+
+// Retention Политика хранения истории метрик и состояние её применения
+type Retention struct {
+	Raw             string     `json:"raw"`
+	Minute          string     `json:"minute"`
+	Hourly          string     `json:"hourly"`
+	CompactInterval string     `json:"compactInterval"`
+	LastCompaction  *time.Time `json:"lastCompaction,omitempty"`
+	LastError       string     `json:"lastError,omitempty"`
+}
+
+func RetentionCreator(policy storage.RetentionPolicy, interval time.Duration, lastRun time.Time, lastErr error) ([]byte, error) {
+	retention := Retention{
+		Raw:             policy.Raw.String(),
+		Minute:          policy.Minute.String(),
+		Hourly:          policy.Hourly.String(),
+		CompactInterval: interval.String(),
+	}
+	if policy.Hourly == 0 {
+		retention.Hourly = "forever"
+	}
+	if !lastRun.IsZero() {
+		retention.LastCompaction = &lastRun
+	}
+	if lastErr != nil {
+		retention.LastError = lastErr.Error()
+	}
+	return json.Marshal(retention)
+}
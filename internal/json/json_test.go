@@ -2,6 +2,7 @@ package json
 
 import (
 	"bytes"
+	"context"
 	"github.com/CvitoyBamp/metricsexporter/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -43,7 +44,7 @@ func TestCreator(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.testName, func(t *testing.T) {
-			res, err := Creator(tt.data.metricValue, tt.data.metricType, tt.data.metricName)
+			res, err := Creator(tt.data.metricValue, tt.data.metricType, tt.data.metricName, nil)
 			require.NoError(t, err)
 			assert.Equal(t, tt.res, string(res))
 		})
@@ -118,13 +119,26 @@ func TestMetricConverter(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.testName, func(t *testing.T) {
-			errSet := ms.SetMetric(tt.data.metricType, tt.data.metricName, tt.data.metricValue)
+			errSet := ms.SetMetric(context.Background(), tt.data.metricType, tt.data.metricName, nil, tt.data.metricValue)
 			require.NoError(t, errSet)
 			b, errConv := MetricConverter(ms)
 			require.NoError(t, errConv)
 			assert.Equal(t, tt.resp, string(b))
-			errDel := ms.DeleteMetric(tt.data.metricType, tt.data.metricName)
+			errDel := ms.DeleteMetric(context.Background(), tt.data.metricType, tt.data.metricName, nil)
 			require.NoError(t, errDel)
 		})
 	}
 }
+
+func TestListDecoder(t *testing.T) {
+	data, err := ListCreator(map[string]float64{"testGauge": 1.5}, map[string]int64{"testCounter": 2}, nil)
+	require.NoError(t, err)
+
+	gm, cm, err := ListDecoder(data)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"testGauge": 1.5}, gm)
+	assert.Equal(t, map[string]int64{"testCounter": 2}, cm)
+
+	_, _, err = ListDecoder([]byte(`[{"id":"testGauge","type":"histogram"}]`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+	"time"
+)
+
+const (
+	GaugeType   = "gauge"
+	CounterType = "counter"
+)
+
+// Metric Значение, снятое сборщиком: Value для gauge, Delta - приращение для counter
+type Metric struct {
+	Name  string
+	MType string
+	Value float64
+	Delta int64
+}
+
+func Gauge(name string, value float64) Metric {
+	return Metric{Name: name, MType: GaugeType, Value: value}
+}
+
+func Counter(name string, delta int64) Metric {
+	return Metric{Name: name, MType: CounterType, Delta: delta}
+}
+
+// Collector Источник метрик агента. Агент вызывает Collect раз в Interval,
+// нулевой интервал означает интервал опроса агента
+type Collector interface {
+	Name() string
+	Interval() time.Duration
+	// Collect Снимает метрики. Вместе с ошибкой можно вернуть то, что удалось собрать
+	Collect(ctx context.Context) ([]Metric, error)
+}
+
+// Apply Записывает собранные метрики: gauge заменяются, counter увеличиваются на Delta
+func (ms *Metrics) Apply(metrics []Metric) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, m := range metrics {
+		switch m.MType {
+		case GaugeType:
+			ms.Gauge[m.Name] = m.Value
+		case CounterType:
+			ms.Counter[m.Name] += m.Delta
+		}
+	}
+}
+
+// RuntimeCollector Метрики runtime.MemStats агента, RandomValue и счётчик опросов PollCount.
+// Режим совместимости с прежними именами метрик, runtime.ReadMemStats останавливает мир на время чтения
+type RuntimeCollector struct {
+	interval time.Duration
+}
+
+func CreateRuntimeCollector(interval time.Duration) *RuntimeCollector {
+	return &RuntimeCollector{
+		interval: interval,
+	}
+}
+
+func (rc *RuntimeCollector) Name() string {
+	return "runtime"
+}
+
+func (rc *RuntimeCollector) Interval() time.Duration {
+	return rc.interval
+}
+
+func (rc *RuntimeCollector) Collect(context.Context) ([]Metric, error) {
+	var rm runtime.MemStats
+	runtime.ReadMemStats(&rm)
+
+	runtimeMetrics := getRuntimeMetrics(&rm)
+	metrics := make([]Metric, 0, len(runtimeMetrics.m)+2)
+	for k, v := range runtimeMetrics.m {
+		metrics = append(metrics, Gauge(k, v))
+	}
+	metrics = append(metrics, Gauge("RandomValue", rand.Float64()), Counter("PollCount", 1))
+
+	return metrics, nil
+}
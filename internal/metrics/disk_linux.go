@@ -0,0 +1,14 @@
+//go:build linux
+
+package metrics
+
+import "syscall"
+
+// diskUsage Размер и свободное место файловой системы в байтах
+func diskUsage(path string) (total, free float64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return float64(st.Blocks) * float64(st.Bsize), float64(st.Bavail) * float64(st.Bsize), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package metrics
+
+import "errors"
+
+// diskUsage Размер файловой системы доступен только через statfs Linux
+func diskUsage(string) (total, free float64, err error) {
+	return 0, 0, errors.New("disk usage is supported on linux only")
+}
@@ -0,0 +1,265 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultProcPath Точка монтирования procfs по умолчанию
+const DefaultProcPath = "/proc"
+
+// cpuTimes Счётчики времени одного процессора из /proc/stat в тиках
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+// HostCollector Собирает метрики машины, на которой работает агент, из procfs:
+// память, загрузку процессоров, load average, заполненность дисков и трафик сетевых интерфейсов
+type HostCollector struct {
+	ProcPath string
+	interval time.Duration
+	// prevCPU Счётчики процессоров с прошлого сбора, загрузка считается по разнице с ними
+	prevCPU []cpuTimes
+	mu      sync.Mutex
+}
+
+func CreateHostCollector(procPath string, interval time.Duration) *HostCollector {
+	if procPath == "" {
+		procPath = DefaultProcPath
+	}
+	return &HostCollector{
+		ProcPath: procPath,
+		interval: interval,
+	}
+}
+
+func (hc *HostCollector) Name() string {
+	return "host"
+}
+
+func (hc *HostCollector) Interval() time.Duration {
+	return hc.interval
+}
+
+// Collect Читает метрики машины. Ошибка одного источника не мешает остальным,
+// собранное возвращается вместе с объединённой ошибкой
+func (hc *HostCollector) Collect(context.Context) ([]Metric, error) {
+	gauges := make(map[string]float64)
+
+	var errs []error
+	for _, collect := range []func(map[string]float64) error{
+		hc.collectMemory,
+		hc.collectCPU,
+		hc.collectLoadAverage,
+		hc.collectDisks,
+		hc.collectNetwork,
+	} {
+		if err := collect(gauges); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	metrics := make([]Metric, 0, len(gauges))
+	for k, v := range gauges {
+		metrics = append(metrics, Gauge(k, v))
+	}
+	return metrics, errors.Join(errs...)
+}
+
+func (hc *HostCollector) path(name string) string {
+	return filepath.Join(hc.ProcPath, name)
+}
+
+// readFields Построчно читает файл procfs, разбивая строки на поля, пустые строки пропускаются
+func (hc *HostCollector) readFields(name string, fn func(fields []string)) error {
+	file, err := os.Open(hc.path(name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			fn(fields)
+		}
+	}
+	return scanner.Err()
+}
+
+// collectMemory TotalMemory и FreeMemory в байтах из /proc/meminfo
+func (hc *HostCollector) collectMemory(gauges map[string]float64) error {
+	names := map[string]string{
+		"MemTotal:": "TotalMemory",
+		"MemFree:":  "FreeMemory",
+	}
+
+	err := hc.readFields("meminfo", func(fields []string) {
+		name, ok := names[fields[0]]
+		if !ok || len(fields) < 2 {
+			return
+		}
+		kb, errParse := strconv.ParseFloat(fields[1], 64)
+		if errParse != nil {
+			return
+		}
+		gauges[name] = kb * 1024
+	})
+	if err != nil {
+		return fmt.Errorf("can't read memory info: %w", err)
+	}
+	return nil
+}
+
+// collectCPU CPUutilization1..N в процентах из /proc/stat. Загрузка считается с прошлого сбора,
+// при первом сборе - с момента загрузки системы
+func (hc *HostCollector) collectCPU(gauges map[string]float64) error {
+	var cpus []cpuTimes
+
+	err := hc.readFields("stat", func(fields []string) {
+		// Строка cpu - сумма по всем процессорам, нужны только cpu0, cpu1 и т.д.
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+			return
+		}
+		var t cpuTimes
+		// user nice system idle iowait irq softirq steal, guest уже учтён в user
+		for i, field := range fields[1:] {
+			if i == 8 {
+				break
+			}
+			v, errParse := strconv.ParseUint(field, 10, 64)
+			if errParse != nil {
+				return
+			}
+			t.total += v
+			if i == 3 || i == 4 {
+				t.idle += v
+			}
+		}
+		cpus = append(cpus, t)
+	})
+	if err != nil {
+		return fmt.Errorf("can't read cpu stat: %w", err)
+	}
+
+	hc.mu.Lock()
+	prev := hc.prevCPU
+	hc.prevCPU = cpus
+	hc.mu.Unlock()
+
+	for i, cur := range cpus {
+		var last cpuTimes
+		if i < len(prev) && cur.total >= prev[i].total {
+			last = prev[i]
+		}
+		total := cur.total - last.total
+		idle := cur.idle - last.idle
+		utilization := 0.0
+		if total > 0 && idle <= total {
+			utilization = 100 * float64(total-idle) / float64(total)
+		}
+		gauges["CPUutilization"+strconv.Itoa(i+1)] = utilization
+	}
+	return nil
+}
+
+// collectLoadAverage LoadAverage1, LoadAverage5 и LoadAverage15 из /proc/loadavg
+func (hc *HostCollector) collectLoadAverage(gauges map[string]float64) error {
+	data, err := os.ReadFile(hc.path("loadavg"))
+	if err != nil {
+		return fmt.Errorf("can't read load average: %w", err)
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return fmt.Errorf("can't parse load average: %q", data)
+	}
+	for i, name := range []string{"LoadAverage1", "LoadAverage5", "LoadAverage15"} {
+		v, errParse := strconv.ParseFloat(fields[i], 64)
+		if errParse != nil {
+			return fmt.Errorf("can't parse load average: %w", errParse)
+		}
+		gauges[name] = v
+	}
+	return nil
+}
+
+// collectDisks DiskTotal_<точка>, DiskFree_<точка> и DiskUsed_<точка> в байтах
+// для файловых систем на блочных устройствах из /proc/mounts
+func (hc *HostCollector) collectDisks(gauges map[string]float64) error {
+	var mounts []string
+	seen := make(map[string]bool)
+
+	err := hc.readFields("mounts", func(fields []string) {
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/") || seen[fields[1]] {
+			return
+		}
+		seen[fields[1]] = true
+		mounts = append(mounts, fields[1])
+	})
+	if err != nil {
+		return fmt.Errorf("can't read mounts: %w", err)
+	}
+
+	var errs []error
+	for _, mount := range mounts {
+		total, free, errUsage := diskUsage(mount)
+		if errUsage != nil {
+			errs = append(errs, fmt.Errorf("can't get disk usage of %s: %w", mount, errUsage))
+			continue
+		}
+		suffix := mountSuffix(mount)
+		gauges["DiskTotal_"+suffix] = total
+		gauges["DiskFree_"+suffix] = free
+		gauges["DiskUsed_"+suffix] = total - free
+	}
+	return errors.Join(errs...)
+}
+
+// mountSuffix Часть имени метрики для точки монтирования: / - root, /var/lib - var_lib
+func mountSuffix(mount string) string {
+	suffix := strings.ReplaceAll(strings.Trim(mount, "/"), "/", "_")
+	if suffix == "" {
+		return "root"
+	}
+	return suffix
+}
+
+// collectNetwork NetworkReceived_<интерфейс> и NetworkTransmitted_<интерфейс> в байтах из /proc/net/dev
+func (hc *HostCollector) collectNetwork(gauges map[string]float64) error {
+	err := hc.readFields(filepath.Join("net", "dev"), func(fields []string) {
+		// Заголовки не содержат двоеточия после имени интерфейса
+		if !strings.Contains(fields[0], ":") {
+			return
+		}
+		// Имя и первый счётчик могут быть слиты: "eth0:123"
+		name, first, _ := strings.Cut(fields[0], ":")
+		counters := fields[1:]
+		if first != "" {
+			counters = append([]string{first}, counters...)
+		}
+		if len(counters) < 9 {
+			return
+		}
+		received, errRx := strconv.ParseFloat(counters[0], 64)
+		transmitted, errTx := strconv.ParseFloat(counters[8], 64)
+		if errRx != nil || errTx != nil {
+			return
+		}
+		gauges["NetworkReceived_"+name] = received
+		gauges["NetworkTransmitted_"+name] = transmitted
+	})
+	if err != nil {
+		return fmt.Errorf("can't read network stat: %w", err)
+	}
+	return nil
+}
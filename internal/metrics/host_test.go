@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeProcFile(t *testing.T, root, name, data string) {
+	path := filepath.Join(root, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+}
+
+func gaugesOf(metrics []Metric) map[string]float64 {
+	gauges := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		gauges[m.Name] = m.Value
+	}
+	return gauges
+}
+
+func TestHostCollector_Collect(t *testing.T) {
+	root := t.TempDir()
+	writeProcFile(t, root, "meminfo", "MemTotal:       2048 kB\nMemFree:         512 kB\nMemAvailable:   1024 kB\n")
+	writeProcFile(t, root, "stat", "cpu  20 0 20 160 0 0 0 0 0 0\ncpu0 10 0 10 80 0 0 0 0 0 0\ncpu1 10 0 10 80 0 0 0 0 0 0\nintr 1\n")
+	writeProcFile(t, root, "loadavg", "0.50 0.25 0.10 1/100 1234\n")
+	writeProcFile(t, root, "mounts", "/dev/sda1 / ext4 rw 0 0\nproc /proc proc rw 0 0\n")
+	writeProcFile(t, root, "net/dev", "Inter-|   Receive                                                |  Transmit\n"+
+		" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n"+
+		"    lo:  100       1    0    0    0     0          0         0      200       2    0    0    0     0       0          0\n"+
+		"  eth0:300       3    0    0    0     0          0         0      400       4    0    0    0     0       0          0\n")
+
+	hc := CreateHostCollector(root, 0)
+	collected, err := hc.Collect(context.Background())
+	require.NoError(t, err)
+	gauges := gaugesOf(collected)
+
+	assert.Equal(t, 2048.0*1024, gauges["TotalMemory"])
+	assert.Equal(t, 512.0*1024, gauges["FreeMemory"])
+	assert.Equal(t, 20.0, gauges["CPUutilization1"])
+	assert.Equal(t, 20.0, gauges["CPUutilization2"])
+	assert.Equal(t, 0.5, gauges["LoadAverage1"])
+	assert.Equal(t, 0.1, gauges["LoadAverage15"])
+	assert.Contains(t, gauges, "DiskTotal_root")
+	assert.NotContains(t, gauges, "DiskTotal_proc")
+	assert.Equal(t, 100.0, gauges["NetworkReceived_lo"])
+	assert.Equal(t, 300.0, gauges["NetworkReceived_eth0"])
+	assert.Equal(t, 400.0, gauges["NetworkTransmitted_eth0"])
+
+	// Загрузка второго сбора считается по разнице с первым
+	writeProcFile(t, root, "stat", "cpu0 60 0 10 130 0 0 0 0 0 0\ncpu1 10 0 10 180 0 0 0 0 0 0\n")
+	collected, err = hc.Collect(context.Background())
+	require.NoError(t, err)
+	gauges = gaugesOf(collected)
+	assert.Equal(t, 50.0, gauges["CPUutilization1"])
+	assert.Equal(t, 0.0, gauges["CPUutilization2"])
+
+	_, err = CreateHostCollector(t.TempDir(), 0).Collect(context.Background())
+	require.Error(t, err)
+}
@@ -7,10 +7,13 @@ import (
 	"sync"
 )
 
+// Metrics Метрики агента. Counter хранит приращения счётчиков, ещё не подтверждённые сервером
 type Metrics struct {
 	sync.RWMutex
 	Gauge   map[string]float64
 	Counter map[string]int64
+	// inflight Приращения счётчиков, которые уже отправляются, чтобы не отправить их повторно в другом снимке
+	inflight map[string]int64
 }
 
 type RuntimeMetrics struct {
@@ -61,3 +64,63 @@ func (ms *Metrics) MetricGenerator(rm runtime.MemStats) *Metrics {
 
 	return ms
 }
+
+// Snapshot Копия метрик на момент отправки, с которой можно работать без блокировки.
+// Counter содержит приращения счётчиков, которые ещё не отправлялись
+type Snapshot struct {
+	Gauge   map[string]float64
+	Counter map[string]int64
+}
+
+// Reserve Возвращает снимок для отправки и помечает попавшие в него приращения счётчиков как отправляемые.
+// После отправки их нужно передать в Ack при ответе 200 или в Release при ошибке
+func (ms *Metrics) Reserve() Snapshot {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if ms.inflight == nil {
+		ms.inflight = make(map[string]int64)
+	}
+
+	s := Snapshot{
+		Gauge:   make(map[string]float64, len(ms.Gauge)),
+		Counter: make(map[string]int64, len(ms.Counter)),
+	}
+	for k, v := range ms.Gauge {
+		s.Gauge[k] = v
+	}
+	for k, v := range ms.Counter {
+		if delta := v - ms.inflight[k]; delta != 0 {
+			s.Counter[k] = delta
+			ms.inflight[k] += delta
+		}
+	}
+	return s
+}
+
+// Ack Вычитает приращения, подтверждённые сервером
+func (ms *Metrics) Ack(counters map[string]int64) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for k, v := range counters {
+		ms.Counter[k] -= v
+		ms.release(k, v)
+	}
+}
+
+// Release Возвращает неотправленные приращения, они уйдут со следующим снимком
+func (ms *Metrics) Release(counters map[string]int64) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for k, v := range counters {
+		ms.release(k, v)
+	}
+}
+
+func (ms *Metrics) release(name string, delta int64) {
+	if ms.inflight[name] -= delta; ms.inflight[name] == 0 {
+		delete(ms.inflight, name)
+	}
+}
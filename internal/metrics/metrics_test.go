@@ -1,8 +1,12 @@
 package metrics
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
 	"runtime"
+	rtmetrics "runtime/metrics"
 	"testing"
 )
 
@@ -47,3 +51,81 @@ func TestMetrics_MetricGenerator(t *testing.T) {
 		})
 	}
 }
+
+func TestMetrics_Apply(t *testing.T) {
+	ms := &Metrics{
+		Gauge:   make(map[string]float64),
+		Counter: make(map[string]int64),
+	}
+
+	collected, err := CreateRuntimeCollector(0).Collect(context.Background())
+	assert.NoError(t, err)
+	ms.Apply(collected)
+	ms.Apply([]Metric{Gauge("RandomValue", 1), Counter("PollCount", 2)})
+
+	assert.Contains(t, ms.Gauge, "TotalAlloc")
+	assert.Equal(t, 1.0, ms.Gauge["RandomValue"])
+	assert.Equal(t, int64(3), ms.Counter["PollCount"])
+}
+
+func TestRuntimeMetricsCollector_Collect(t *testing.T) {
+	_, err := CreateRuntimeMetricsCollector(0, []string{"/unknown:metric"})
+	assert.Error(t, err)
+
+	rc, err := CreateRuntimeMetricsCollector(0, nil)
+	require.NoError(t, err)
+	ms := &Metrics{
+		Gauge:   make(map[string]float64),
+		Counter: make(map[string]int64),
+	}
+	collected, err := rc.Collect(context.Background())
+	require.NoError(t, err)
+	ms.Apply(collected)
+
+	assert.Greater(t, ms.Gauge["sched_goroutines_goroutines"], 0.0)
+	assert.Contains(t, ms.Gauge, "gc_pauses_seconds_count")
+	assert.Contains(t, ms.Gauge, "sched_latencies_seconds_bucket_0_001")
+	assert.Equal(t, int64(1), ms.Counter["PollCount"])
+
+	all, err := CreateRuntimeMetricsCollector(0, []string{AllRuntimeMetrics})
+	require.NoError(t, err)
+	assert.Greater(t, len(all.samples), len(rc.samples))
+}
+
+func Test_histogramMetrics(t *testing.T) {
+	h := &rtmetrics.Float64Histogram{
+		Counts:  []uint64{1, 2, 3, 4},
+		Buckets: []float64{math.Inf(-1), 0.5, 5, 50, math.Inf(1)},
+	}
+
+	collected := histogramMetrics("test", h, []float64{1, 10})
+	assert.Equal(t, []Metric{Gauge("test_bucket_1", 1), Gauge("test_bucket_10", 3), Gauge("test_count", 10)}, collected)
+
+	collected = histogramMetrics("test", h, []float64{1e-6, 0.5})
+	assert.Equal(t, []Metric{Gauge("test_bucket_0_000001", 0), Gauge("test_bucket_0_5", 1), Gauge("test_count", 10)}, collected)
+}
+
+func TestMetrics_Reserve(t *testing.T) {
+	ms := &Metrics{
+		Gauge:   map[string]float64{"testGauge": 1},
+		Counter: map[string]int64{"PollCount": 2},
+	}
+
+	first := ms.Reserve()
+	assert.Equal(t, map[string]int64{"PollCount": 2}, first.Counter)
+
+	// Отправляемое приращение не попадает в следующий снимок
+	ms.Apply([]Metric{Counter("PollCount", 1)})
+	second := ms.Reserve()
+	assert.Equal(t, map[string]int64{"PollCount": 1}, second.Counter)
+	assert.Equal(t, 1.0, second.Gauge["testGauge"])
+
+	ms.Ack(second.Counter)
+	ms.Release(first.Counter)
+	assert.Equal(t, int64(2), ms.Counter["PollCount"])
+
+	third := ms.Reserve()
+	assert.Equal(t, map[string]int64{"PollCount": 2}, third.Counter)
+	ms.Ack(third.Counter)
+	assert.Empty(t, ms.Reserve().Counter)
+}
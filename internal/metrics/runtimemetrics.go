@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	rtmetrics "runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRuntimeMetrics Метрики runtime/metrics, которые собираются, если список не задан
+var DefaultRuntimeMetrics = []string{
+	"/sched/goroutines:goroutines",
+	"/sched/latencies:seconds",
+	"/gc/pauses:seconds",
+	"/gc/cycles/total:gc-cycles",
+	"/gc/heap/allocs:bytes",
+	"/gc/heap/goal:bytes",
+	"/memory/classes/heap/objects:bytes",
+	"/memory/classes/total:bytes",
+}
+
+// AllRuntimeMetrics Значение списка метрик, включающее всё, что поддерживает runtime/metrics
+const AllRuntimeMetrics = "all"
+
+// secondsBuckets Верхние границы корзин гистограмм в секундах
+var secondsBuckets = []float64{1e-6, 1e-5, 1e-4, 1e-3, 1e-2, 1e-1, 1, 10}
+
+// defaultBuckets Верхние границы корзин гистограмм в остальных единицах
+var defaultBuckets = []float64{1, 10, 100, 1e3, 1e4, 1e5, 1e6}
+
+// RuntimeMetricsCollector Метрики агента из runtime/metrics, который в отличие от runtime.ReadMemStats
+// не останавливает мир. Гистограммы отправляются корзинами <имя>_bucket_<граница> (граница 0.001 - 0_001)
+// с накопленным числом событий не больше границы и общим числом событий <имя>_count
+type RuntimeMetricsCollector struct {
+	interval time.Duration
+	samples  []rtmetrics.Sample
+}
+
+// CreateRuntimeMetricsCollector Создаёт сборщик метрик names, пустой список - DefaultRuntimeMetrics,
+// AllRuntimeMetrics - все метрики runtime/metrics
+func CreateRuntimeMetricsCollector(interval time.Duration, names []string) (*RuntimeMetricsCollector, error) {
+	supported := make(map[string]bool)
+	var all []string
+	for _, d := range rtmetrics.All() {
+		if d.Kind == rtmetrics.KindBad {
+			continue
+		}
+		supported[d.Name] = true
+		all = append(all, d.Name)
+	}
+
+	switch {
+	case len(names) == 0:
+		names = DefaultRuntimeMetrics
+	case len(names) == 1 && names[0] == AllRuntimeMetrics:
+		names = all
+	}
+
+	samples := make([]rtmetrics.Sample, 0, len(names))
+	for _, name := range names {
+		if !supported[name] {
+			return nil, fmt.Errorf("runtime metric %s isn't supported", name)
+		}
+		samples = append(samples, rtmetrics.Sample{Name: name})
+	}
+
+	return &RuntimeMetricsCollector{
+		interval: interval,
+		samples:  samples,
+	}, nil
+}
+
+func (rc *RuntimeMetricsCollector) Name() string {
+	return "runtime"
+}
+
+func (rc *RuntimeMetricsCollector) Interval() time.Duration {
+	return rc.interval
+}
+
+func (rc *RuntimeMetricsCollector) Collect(context.Context) ([]Metric, error) {
+	rtmetrics.Read(rc.samples)
+
+	metrics := make([]Metric, 0, len(rc.samples)+2)
+	for _, sample := range rc.samples {
+		name := runtimeMetricName(sample.Name)
+		switch sample.Value.Kind() {
+		case rtmetrics.KindUint64:
+			metrics = append(metrics, Gauge(name, float64(sample.Value.Uint64())))
+		case rtmetrics.KindFloat64:
+			metrics = append(metrics, Gauge(name, sample.Value.Float64()))
+		case rtmetrics.KindFloat64Histogram:
+			bounds := defaultBuckets
+			if strings.HasSuffix(sample.Name, ":seconds") {
+				bounds = secondsBuckets
+			}
+			metrics = append(metrics, histogramMetrics(name, sample.Value.Float64Histogram(), bounds)...)
+		}
+	}
+	metrics = append(metrics, Gauge("RandomValue", rand.Float64()), Counter("PollCount", 1))
+
+	return metrics, nil
+}
+
+// nameReplacer Заменяет в имени метрики символы, которые не допускают форматы экспозиции
+var nameReplacer = strings.NewReplacer("/", "_", ":", "_", "-", "_", ".", "_")
+
+// runtimeMetricName Имя метрики агента для метрики runtime/metrics: /gc/pauses:seconds - gc_pauses_seconds
+func runtimeMetricName(name string) string {
+	return nameReplacer.Replace(strings.TrimPrefix(name, "/"))
+}
+
+// bucketName Имя корзины гистограммы name с верхней границей bound: 0.001 - <name>_bucket_0_001
+func bucketName(name string, bound float64) string {
+	return name + "_bucket_" + nameReplacer.Replace(strconv.FormatFloat(bound, 'f', -1, 64))
+}
+
+// histogramMetrics Сводит мелкие корзины гистограммы runtime к границам bounds.
+// Событие попадает в корзину, если верхняя граница его исходной корзины не больше границы bounds
+func histogramMetrics(name string, h *rtmetrics.Float64Histogram, bounds []float64) []Metric {
+	metrics := make([]Metric, 0, len(bounds)+1)
+
+	var total uint64
+	cumulative := make([]uint64, len(bounds))
+	for i, count := range h.Counts {
+		total += count
+		upper := h.Buckets[i+1]
+		for j, bound := range bounds {
+			if upper <= bound {
+				cumulative[j] += count
+			}
+		}
+	}
+
+	for j, bound := range bounds {
+		metrics = append(metrics, Gauge(bucketName(name, bound), float64(cumulative[j])))
+	}
+	metrics = append(metrics, Gauge(name+"_count", float64(total)))
+
+	return metrics
+}
@@ -0,0 +1,51 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"github.com/CvitoyBamp/metricsexporter/internal/crypt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// MiddlewareDecrypt Расшифровывает тело запроса, помеченное заголовком Encryption, закрытым ключом сервера.
+// Незашифрованные запросы пропускаются как есть, без ключа расшифровка отключена
+func MiddlewareDecrypt(key *rsa.PrivateKey) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if key == nil {
+			return h
+		}
+		decrypt := func(res http.ResponseWriter, req *http.Request) {
+			scheme := req.Header.Get(crypt.Header)
+			if scheme == "" {
+				h.ServeHTTP(res, req)
+				return
+			}
+			if scheme != crypt.Scheme {
+				http.Error(res, "Unsupported encryption scheme", http.StatusBadRequest)
+				return
+			}
+
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				readError(res, err)
+				return
+			}
+			req.Body.Close()
+
+			plain, err := crypt.Decrypt(key, body)
+			if err != nil {
+				log.Printf("can't decrypt request %s %s: %s", req.Method, req.URL.Path, err)
+				http.Error(res, "Can't decrypt request body", http.StatusBadRequest)
+				return
+			}
+
+			req.Header.Del(crypt.Header)
+			req.ContentLength = int64(len(plain))
+			req.Body = io.NopCloser(bytes.NewReader(plain))
+			h.ServeHTTP(res, req)
+		}
+		return http.HandlerFunc(decrypt)
+	}
+}
@@ -0,0 +1,60 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/CvitoyBamp/metricsexporter/internal/crypt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	body := []byte(`{"id":"Alloc","type":"gauge","value":1}`)
+
+	encrypted, err := crypt.Encrypt(&key.PublicKey, body)
+	require.NoError(t, err)
+
+	echo := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		data, _ := io.ReadAll(req.Body)
+		res.Write(data)
+	})
+
+	tests := []struct {
+		testName string
+		body     []byte
+		scheme   string
+		code     int
+	}{
+		{testName: "Encrypted request", body: encrypted, scheme: crypt.Scheme, code: http.StatusOK},
+		{testName: "Plain request", body: body, code: http.StatusOK},
+		{testName: "Broken ciphertext", body: body, scheme: crypt.Scheme, code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			ts := httptest.NewServer(MiddlewareDecrypt(key)(echo))
+			defer ts.Close()
+			req, err := http.NewRequest(http.MethodPost, ts.URL, bytes.NewReader(tt.body))
+			require.NoError(t, err)
+			if tt.scheme != "" {
+				req.Header.Set(crypt.Header, tt.scheme)
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+
+			if tt.code == http.StatusOK {
+				data, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, body, data)
+			}
+		})
+	}
+}
@@ -1,23 +1,133 @@
 package middlewares
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"errors"
 	"fmt"
+	"github.com/klauspost/compress/zstd"
 	"io"
+	"log"
+	"mime"
 	"net/http"
 	"strings"
 )
 
+// DefaultMaxBodySize Ограничение размера тела запроса, полученного и распакованного, по умолчанию
+const DefaultMaxBodySize = 10 << 20
+
+// errBodyTooLarge Распакованное тело запроса превысило ограничение
+var errBodyTooLarge = errors.New("request body is too large")
+
+// tooLarge Проверяет, что тело запроса не прочитано из-за ограничения размера
+func tooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr) || errors.Is(err, errBodyTooLarge)
+}
+
+// readError Отвечает на ошибку чтения тела запроса: 413, если тело больше ограничения, иначе 400
+func readError(res http.ResponseWriter, err error) {
+	if tooLarge(err) {
+		http.Error(res, "Request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(res, "Can't read request body", http.StatusBadRequest)
+}
+
+// MiddlewareMaxBodySize Ограничивает тело запроса maxSize байтами до проверки подписи, расшифровки и распаковки.
+// Нулевой maxSize означает DefaultMaxBodySize
+func MiddlewareMaxBodySize(maxSize int64) func(http.Handler) http.Handler {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBodySize
+	}
+	return func(h http.Handler) http.Handler {
+		limit := func(res http.ResponseWriter, req *http.Request) {
+			req.Body = http.MaxBytesReader(res, req.Body, maxSize)
+			h.ServeHTTP(res, req)
+		}
+		return http.HandlerFunc(limit)
+	}
+}
+
+// compressibleTypes Типы содержимого, ответы с которыми имеет смысл сжимать
+var compressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/openmetrics-text",
+	"image/svg+xml",
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter Сжимает ответ, если его тип содержимого сжимаемый. Решение принимается при отправке заголовков:
+// по Content-Type, выставленному обработчиком, либо по первым байтам ответа
 type gzipWriter struct {
 	http.ResponseWriter
-	Writer io.Writer
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *gzipWriter) decide(data []byte) {
+	w.decided = true
+	contentType := w.Header().Get("Content-Type")
+	if contentType == "" && len(data) > 0 {
+		contentType = http.DetectContentType(data)
+	}
+	if !compressible(contentType) {
+		return
+	}
+
+	gz, err := gzip.NewWriterLevel(w.ResponseWriter, gzip.BestSpeed)
+	if err != nil {
+		log.Printf("can't create gzip writer: %s", err)
+		return
+	}
+	w.gz = gz
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+}
+
+func (w *gzipWriter) WriteHeader(statusCode int) {
+	if !w.decided {
+		w.decide(nil)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
 }
 
-func (w gzipWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.decide(b)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+func (w *gzipWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
 }
 
+// MiddlewareZIP Сжимает ответы со сжимаемым содержимым в gzip, если клиент принимает gzip
 func MiddlewareZIP(h http.Handler) http.Handler {
 	zip := func(res http.ResponseWriter, req *http.Request) {
 
@@ -26,25 +136,110 @@ func MiddlewareZIP(h http.Handler) http.Handler {
 			return
 		}
 
-		gz, err := gzip.NewWriterLevel(res, gzip.BestSpeed)
-		if err != nil {
-			io.WriteString(res, err.Error())
-			return
+		res.Header().Add("Vary", "Accept-Encoding")
+		gw := &gzipWriter{ResponseWriter: res}
+		defer gw.Close()
+
+		h.ServeHTTP(gw, req)
+	}
+	return http.HandlerFunc(zip)
+}
+
+// MiddlewareDecompress Распаковывает тело запроса по заголовку Content-Encoding: gzip, deflate или zstd.
+// Тело, которое после распаковки больше maxSize байт, отклоняется с кодом 413, неизвестное сжатие - с кодом 415.
+// Нулевой maxSize означает DefaultMaxBodySize
+func MiddlewareDecompress(maxSize int64) func(http.Handler) http.Handler {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBodySize
+	}
+	return func(h http.Handler) http.Handler {
+		decompress := func(res http.ResponseWriter, req *http.Request) {
+			encodings := parseEncodings(req.Header.Get("Content-Encoding"))
+			if len(encodings) == 0 {
+				h.ServeHTTP(res, req)
+				return
+			}
+
+			var body io.Reader = req.Body
+			// Кодировки перечислены в порядке применения, поэтому снимаются с конца
+			for i := len(encodings) - 1; i >= 0; i-- {
+				r, err := newDecoder(encodings[i], body, maxSize)
+				if err != nil {
+					log.Printf("can't decode request body: %s", err)
+					http.Error(res, err.Error(), http.StatusUnsupportedMediaType)
+					return
+				}
+				defer r.Close()
+				body = r
+			}
+
+			data, err := readLimited(body, maxSize)
+			if tooLarge(err) {
+				http.Error(res, "Request body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				log.Printf("can't decompress request body: %s", err)
+				http.Error(res, "Can't decompress request body", http.StatusBadRequest)
+				return
+			}
+			req.Body.Close()
+
+			req.Header.Del("Content-Encoding")
+			req.Header.Del("Content-Length")
+			req.ContentLength = int64(len(data))
+			req.Body = io.NopCloser(bytes.NewReader(data))
+			h.ServeHTTP(res, req)
 		}
-		defer gz.Close()
+		return http.HandlerFunc(decompress)
+	}
+}
 
-		//if strings.Contains(req.Header.Get("Content-Encoding"), "gzip") {
-		//	req.Body, err = gzip.NewReader(req.Body)
-		//	if err != nil {
-		//		http.Error(res, err.Error(), http.StatusInternalServerError)
-		//		return
-		//	}
-		//}
+func parseEncodings(header string) []string {
+	var encodings []string
+	for _, e := range strings.Split(header, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e != "" && e != "identity" {
+			encodings = append(encodings, e)
+		}
+	}
+	return encodings
+}
 
-		res.Header().Set("Content-Encoding", "gzip")
-		h.ServeHTTP(gzipWriter{ResponseWriter: res, Writer: gz}, req)
+// newDecoder Создаёт распаковщик encoding, maxSize ограничивает память распаковщика zstd
+func newDecoder(encoding string, r io.Reader, maxSize int64) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// По HTTP deflate - это поток zlib, но часть клиентов шлёт сырой deflate без заголовка
+		br := bufio.NewReader(r)
+		header, err := br.Peek(2)
+		if err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "zstd":
+		d, err := zstd.NewReader(r, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", encoding)
 	}
-	return http.HandlerFunc(zip)
+}
+
+// readLimited Читает r целиком, но не больше limit байт
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
 }
 
 func Compress(data []byte) ([]byte, error) {
@@ -1,7 +1,12 @@
 package middlewares
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/require"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -62,3 +67,94 @@ func TestGzipWriter(t *testing.T) {
 		})
 	}
 }
+
+func TestMiddlewareDecompress(t *testing.T) {
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+
+	gzipped, err := Compress(body)
+	require.NoError(t, err)
+
+	var zlibbed bytes.Buffer
+	zw := zlib.NewWriter(&zlibbed)
+	zw.Write(body)
+	zw.Close()
+
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.BestSpeed)
+	fw.Write(body)
+	fw.Close()
+
+	enc, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	zstded := enc.EncodeAll(body, nil)
+
+	bomb, err := Compress(make([]byte, 2048))
+	require.NoError(t, err)
+
+	echo := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		data, _ := io.ReadAll(req.Body)
+		res.Write(data)
+	})
+
+	tests := []struct {
+		testName string
+		encoding string
+		body     []byte
+		code     int
+	}{
+		{testName: "Gzip body", encoding: "gzip", body: gzipped, code: http.StatusOK},
+		{testName: "Zlib deflate body", encoding: "deflate", body: zlibbed.Bytes(), code: http.StatusOK},
+		{testName: "Raw deflate body", encoding: "deflate", body: deflated.Bytes(), code: http.StatusOK},
+		{testName: "Zstd body", encoding: "zstd", body: zstded, code: http.StatusOK},
+		{testName: "Plain body", body: body, code: http.StatusOK},
+		{testName: "Body over the limit", encoding: "gzip", body: bomb, code: http.StatusRequestEntityTooLarge},
+		{testName: "Unknown encoding", encoding: "br", body: body, code: http.StatusUnsupportedMediaType},
+		{testName: "Broken gzip", encoding: "gzip", body: body, code: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			ts := httptest.NewServer(MiddlewareDecompress(1024)(echo))
+			defer ts.Close()
+			req, err := http.NewRequest(http.MethodPost, ts.URL, bytes.NewReader(tt.body))
+			require.NoError(t, err)
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+
+			if tt.code == http.StatusOK {
+				data, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, body, data)
+			}
+		})
+	}
+}
+
+func TestGzipWriter_ContentType(t *testing.T) {
+	tests := []struct {
+		contentType     string
+		contentEncoding string
+	}{
+		{contentType: "application/json", contentEncoding: "gzip"},
+		{contentType: "text/html; charset=utf-8", contentEncoding: "gzip"},
+		{contentType: "image/png", contentEncoding: ""},
+		{contentType: "application/octet-stream", contentEncoding: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			h := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.Header().Set("Content-Type", tt.contentType)
+				res.Write([]byte("data"))
+			})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			MiddlewareZIP(h).ServeHTTP(rec, req)
+			assert.Equal(t, tt.contentEncoding, rec.Header().Get("Content-Encoding"))
+		})
+	}
+}
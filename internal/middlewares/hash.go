@@ -0,0 +1,87 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+)
+
+// HashHeader Заголовок с HMAC-SHA256 подписью тела запроса или ответа в hex
+const HashHeader = "HashSHA256"
+
+// Sign Возвращает HMAC-SHA256 подпись данных ключом key в hex
+func Sign(data []byte, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify Проверяет, что sign - подпись данных ключом key
+func Verify(data []byte, key, sign string) bool {
+	expected, err := hex.DecodeString(sign)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+type hashWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *hashWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *hashWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+// MiddlewareHash Проверяет подпись тела запроса из заголовка HashSHA256 и подписывает ответ тем же ключом.
+// Запросы, изменяющие метрики, без подписи или с неверной подписью отклоняются с кодом 400.
+// С пустым ключом проверка отключена
+func MiddlewareHash(key string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if key == "" {
+			return h
+		}
+		hash := func(res http.ResponseWriter, req *http.Request) {
+			sign := req.Header.Get(HashHeader)
+			if sign != "" || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+				body, err := io.ReadAll(req.Body)
+				if err != nil {
+					readError(res, err)
+					return
+				}
+				req.Body.Close()
+				if !Verify(body, key, sign) {
+					log.Printf("request %s %s has incorrect %s signature", req.Method, req.URL.Path, HashHeader)
+					http.Error(res, "Incorrect signature of request body", http.StatusBadRequest)
+					return
+				}
+				req.Body = io.NopCloser(bytes.NewReader(body))
+			}
+
+			hw := &hashWriter{ResponseWriter: res}
+			h.ServeHTTP(hw, req)
+
+			if hw.status == 0 {
+				hw.status = http.StatusOK
+			}
+			res.Header().Set(HashHeader, Sign(hw.body.Bytes(), key))
+			res.WriteHeader(hw.status)
+			res.Write(hw.body.Bytes())
+		}
+		return http.HandlerFunc(hash)
+	}
+}
@@ -0,0 +1,74 @@
+package middlewares
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareHash(t *testing.T) {
+	const key = "secret"
+	body := []byte(`{"id":"Alloc","type":"gauge","value":1}`)
+
+	echo := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		data, _ := io.ReadAll(req.Body)
+		res.Write(data)
+	})
+
+	tests := []struct {
+		testName string
+		method   string
+		sign     string
+		code     int
+	}{
+		{testName: "Correct signature", method: http.MethodPost, sign: Sign(body, key), code: http.StatusOK},
+		{testName: "Incorrect signature", method: http.MethodPost, sign: Sign(body, "other"), code: http.StatusBadRequest},
+		{testName: "Missing signature", method: http.MethodPost, code: http.StatusBadRequest},
+		{testName: "Unsigned read request", method: http.MethodGet, code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			ts := httptest.NewServer(MiddlewareHash(key)(echo))
+			defer ts.Close()
+			req, err := http.NewRequest(tt.method, ts.URL, bytes.NewReader(body))
+			require.NoError(t, err)
+			if tt.sign != "" {
+				req.Header.Set(HashHeader, tt.sign)
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+
+			if tt.code == http.StatusOK {
+				data, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.True(t, Verify(data, key, resp.Header.Get(HashHeader)))
+			}
+		})
+	}
+}
+
+func TestMiddlewareHash_MaxBodySize(t *testing.T) {
+	const key = "secret"
+	body := bytes.Repeat([]byte("a"), 2048)
+
+	echo := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		data, _ := io.ReadAll(req.Body)
+		res.Write(data)
+	})
+	ts := httptest.NewServer(MiddlewareMaxBodySize(1024)(MiddlewareHash(key)(echo)))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set(HashHeader, Sign(body, key))
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
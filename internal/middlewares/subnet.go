@@ -0,0 +1,28 @@
+package middlewares
+
+import (
+	"github.com/CvitoyBamp/metricsexporter/internal/subnet"
+	"log"
+	"net"
+	"net/http"
+)
+
+// MiddlewareTrustedSubnet Пропускает только запросы, у которых адрес из заголовка X-Real-IP входит в доверенную подсеть,
+// остальные отклоняются с кодом 403. Без подсети проверка отключена
+func MiddlewareTrustedSubnet(trusted *net.IPNet) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if trusted == nil {
+			return h
+		}
+		check := func(res http.ResponseWriter, req *http.Request) {
+			realIP := req.Header.Get(subnet.Header)
+			if !subnet.Allowed(trusted, realIP) {
+				log.Printf("request %s %s from %q is outside of trusted subnet %s", req.Method, req.URL.Path, realIP, trusted)
+				http.Error(res, "Forbidden", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(res, req)
+		}
+		return http.HandlerFunc(check)
+	}
+}
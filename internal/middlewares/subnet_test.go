@@ -0,0 +1,44 @@
+package middlewares
+
+import (
+	"github.com/CvitoyBamp/metricsexporter/internal/subnet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareTrustedSubnet(t *testing.T) {
+	trusted, err := subnet.Parse("10.0.0.0/8")
+	require.NoError(t, err)
+
+	tests := []struct {
+		testName string
+		realIP   string
+		code     int
+	}{
+		{testName: "Inside trusted subnet", realIP: "10.1.2.3", code: http.StatusOK},
+		{testName: "Outside trusted subnet", realIP: "192.168.1.1", code: http.StatusForbidden},
+		{testName: "Without X-Real-IP", code: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			ts := httptest.NewServer(MiddlewareTrustedSubnet(trusted)(http.NotFoundHandler()))
+			defer ts.Close()
+			req, err := http.NewRequest(http.MethodPost, ts.URL, nil)
+			require.NoError(t, err)
+			if tt.realIP != "" {
+				req.Header.Set(subnet.Header, tt.realIP)
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			if tt.code == http.StatusOK {
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+			} else {
+				assert.Equal(t, tt.code, resp.StatusCode)
+			}
+		})
+	}
+}
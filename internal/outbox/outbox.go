@@ -0,0 +1,291 @@
+package outbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const segmentExt = ".seg"
+
+// Options Ограничения очереди на диске
+type Options struct {
+	// SegmentSize Размер файла сегмента, после которого записи пишутся в новый сегмент
+	SegmentSize int64
+	// MaxSize Общий размер очереди, при превышении удаляются самые старые сегменты, 0 - без ограничения
+	MaxSize int64
+	// MaxAge Сколько хранится сегмент после последней записи в него, 0 - без ограничения
+	MaxAge time.Duration
+}
+
+// segment Файл очереди с записями, разделёнными переводом строки
+type segment struct {
+	seq      uint64
+	size     int64
+	modified time.Time
+}
+
+// Outbox Очередь записей на диске: записи добавляются в конец последнего сегмента
+// и воспроизводятся по порядку начиная с самого старого
+type Outbox struct {
+	mu       sync.Mutex
+	dir      string
+	opts     Options
+	segments []segment
+	next     uint64
+}
+
+// PartialError Запись передана частично: вместо неё в очереди остаётся непереданная часть Rest
+type PartialError struct {
+	Rest []byte
+	Err  error
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// CreateOutbox Открывает очередь в каталоге dir, созданные ранее сегменты сохраняются
+func CreateOutbox(dir string, opts Options) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{
+		dir:  dir,
+		opts: opts,
+		next: 1,
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), segmentExt) {
+			continue
+		}
+		seq, errParse := strconv.ParseUint(strings.TrimSuffix(entry.Name(), segmentExt), 10, 64)
+		if errParse != nil {
+			continue
+		}
+		info, errInfo := entry.Info()
+		if errInfo != nil {
+			return nil, errInfo
+		}
+		o.segments = append(o.segments, segment{seq: seq, size: info.Size(), modified: info.ModTime()})
+		if seq >= o.next {
+			o.next = seq + 1
+		}
+	}
+	sort.Slice(o.segments, func(i, j int) bool { return o.segments[i].seq < o.segments[j].seq })
+
+	return o, nil
+}
+
+func (o *Outbox) path(seq uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// Append Дописывает запись в очередь. Запись не должна содержать перевод строки
+func (o *Outbox) Append(record []byte) error {
+	if bytes.IndexByte(record, '\n') >= 0 {
+		return errors.New("outbox record can't contain a newline")
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	o.expire(now)
+
+	size := int64(len(record)) + 1
+	if len(o.segments) == 0 || (o.opts.SegmentSize > 0 && o.segments[len(o.segments)-1].size+size > o.opts.SegmentSize) {
+		o.segments = append(o.segments, segment{seq: o.next})
+		o.next++
+	}
+	last := &o.segments[len(o.segments)-1]
+
+	file, err := os.OpenFile(o.path(last.seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	line := make([]byte, 0, size)
+	line = append(append(line, record...), '\n')
+	if _, err = file.Write(line); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	last.size += size
+	last.modified = now
+
+	o.trim()
+	return nil
+}
+
+// Empty Сообщает, что в очереди нет записей
+func (o *Outbox) Empty() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.expire(time.Now())
+	return len(o.segments) == 0
+}
+
+// Replay Передаёт записи в fn по порядку, удаляя переданные. Останавливается на первой ошибке fn,
+// запись с ошибкой и следующие за ней остаются в очереди, а при PartialError запись заменяется её остатком.
+// Прогресс внутри сегмента сохраняется по окончании сегмента или при ошибке,
+// поэтому после падения агента часть записей может повториться
+func (o *Outbox) Replay(fn func(record []byte) error) error {
+	for {
+		seq, data, ok, err := o.oldest()
+		if err != nil || !ok {
+			return err
+		}
+
+		delivered := 0
+		var rest []byte
+		var errFn error
+		for delivered < len(data) {
+			end := bytes.IndexByte(data[delivered:], '\n')
+			if end < 0 {
+				// Недописанная запись остаётся после падения во время записи
+				log.Printf("outbox segment %d has a truncated record, it's skipped", seq)
+				delivered = len(data)
+				break
+			}
+			if errFn = fn(data[delivered : delivered+end]); errFn != nil {
+				var partial *PartialError
+				if errors.As(errFn, &partial) && len(partial.Rest) > 0 && bytes.IndexByte(partial.Rest, '\n') < 0 {
+					rest = partial.Rest
+					delivered += end + 1
+				}
+				break
+			}
+			delivered += end + 1
+		}
+
+		if err = o.commit(seq, int64(delivered), rest); err != nil {
+			return err
+		}
+		if errFn != nil {
+			return errFn
+		}
+	}
+}
+
+// oldest Читает самый старый сегмент
+func (o *Outbox) oldest() (uint64, []byte, bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.expire(time.Now())
+	if len(o.segments) == 0 {
+		return 0, nil, false, nil
+	}
+
+	seq := o.segments[0].seq
+	data, err := os.ReadFile(o.path(seq))
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return seq, data, true, nil
+}
+
+// commit Удаляет из начала сегмента seq переданные delivered байт и ставит в его начало запись head, если она есть.
+// Пустой сегмент удаляется
+func (o *Outbox) commit(seq uint64, delivered int64, head []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	i := o.index(seq)
+	if i < 0 || delivered == 0 {
+		// Сегмент успели удалить по ограничениям очереди
+		return nil
+	}
+
+	path := o.path(seq)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if delivered >= int64(len(data)) && head == nil {
+		o.remove(i)
+		return nil
+	}
+
+	rest := data[delivered:]
+	if head != nil {
+		rest = append(append(append(make([]byte, 0, len(head)+1+len(rest)), head...), '\n'), rest...)
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, rest, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	o.segments[i].size = int64(len(rest))
+	return nil
+}
+
+func (o *Outbox) index(seq uint64) int {
+	for i, s := range o.segments {
+		if s.seq == seq {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove Удаляет сегмент i вместе с файлом
+func (o *Outbox) remove(i int) {
+	if err := os.Remove(o.path(o.segments[i].seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("can't remove outbox segment: %s", err)
+	}
+	o.segments = append(o.segments[:i], o.segments[i+1:]...)
+}
+
+// expire Удаляет сегменты, в которые не писали дольше MaxAge
+func (o *Outbox) expire(now time.Time) {
+	if o.opts.MaxAge <= 0 {
+		return
+	}
+	for len(o.segments) > 0 && now.Sub(o.segments[0].modified) > o.opts.MaxAge {
+		log.Printf("outbox segment %d is older than %s and is dropped", o.segments[0].seq, o.opts.MaxAge)
+		o.remove(0)
+	}
+}
+
+// trim Удаляет самые старые сегменты, пока очередь больше MaxSize. Последний сегмент остаётся всегда
+func (o *Outbox) trim() {
+	if o.opts.MaxSize <= 0 {
+		return
+	}
+	var total int64
+	for _, s := range o.segments {
+		total += s.size
+	}
+	for len(o.segments) > 1 && total > o.opts.MaxSize {
+		log.Printf("outbox is larger than %d bytes, segment %d is dropped", o.opts.MaxSize, o.segments[0].seq)
+		total -= o.segments[0].size
+		o.remove(0)
+	}
+}
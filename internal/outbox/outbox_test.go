@@ -0,0 +1,103 @@
+package outbox
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func replayAll(t *testing.T, o *Outbox, failAt string) ([]string, error) {
+	var records []string
+	err := o.Replay(func(record []byte) error {
+		if string(record) == failAt {
+			return errors.New("server is unavailable")
+		}
+		records = append(records, string(record))
+		return nil
+	})
+	return records, err
+}
+
+func TestOutbox_Replay(t *testing.T) {
+	dir := t.TempDir()
+	o, err := CreateOutbox(dir, Options{SegmentSize: 16})
+	require.NoError(t, err)
+	require.True(t, o.Empty())
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, o.Append([]byte("record"+strconv.Itoa(i))))
+	}
+	require.Error(t, o.Append([]byte("bad\nrecord")))
+	assert.Len(t, o.segments, 5, "a segment holds two records of 8 bytes")
+
+	records, err := replayAll(t, o, "record4")
+	require.Error(t, err)
+	assert.Equal(t, []string{"record0", "record1", "record2", "record3"}, records)
+
+	// Очередь переживает перезапуск агента
+	o, err = CreateOutbox(dir, Options{SegmentSize: 16})
+	require.NoError(t, err)
+	require.NoError(t, o.Append([]byte("record10")))
+
+	records, err = replayAll(t, o, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"record4", "record5", "record6", "record7", "record8", "record9", "record10"}, records)
+	assert.True(t, o.Empty())
+}
+
+func TestOutbox_PartialSegment(t *testing.T) {
+	o, err := CreateOutbox(t.TempDir(), Options{SegmentSize: 1 << 20})
+	require.NoError(t, err)
+	for _, r := range []string{"a", "b", "c"} {
+		require.NoError(t, o.Append([]byte(r)))
+	}
+
+	records, err := replayAll(t, o, "b")
+	require.Error(t, err)
+	assert.Equal(t, []string{"a"}, records)
+
+	records, err = replayAll(t, o, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, records)
+}
+
+func TestOutbox_PartialRecord(t *testing.T) {
+	o, err := CreateOutbox(t.TempDir(), Options{SegmentSize: 1 << 20})
+	require.NoError(t, err)
+	for _, r := range []string{"a", "bc", "d"} {
+		require.NoError(t, o.Append([]byte(r)))
+	}
+
+	// Из записи bc передана только b, в очереди вместо неё остаётся c
+	err = o.Replay(func(record []byte) error {
+		if string(record) == "bc" {
+			return &PartialError{Rest: []byte("c"), Err: errors.New("server is unavailable")}
+		}
+		return nil
+	})
+	require.Error(t, err)
+
+	records, err := replayAll(t, o, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c", "d"}, records)
+	assert.True(t, o.Empty())
+}
+
+func TestOutbox_Limits(t *testing.T) {
+	o, err := CreateOutbox(t.TempDir(), Options{SegmentSize: 2, MaxSize: 4, MaxAge: time.Hour})
+	require.NoError(t, err)
+	for _, r := range []string{"a", "b", "c"} {
+		require.NoError(t, o.Append([]byte(r)))
+	}
+
+	// Самый старый сегмент удалён по размеру очереди
+	records, err := replayAll(t, o, "c")
+	require.Error(t, err)
+	assert.Equal(t, []string{"b"}, records)
+
+	o.segments[0].modified = time.Now().Add(-2 * time.Hour)
+	assert.True(t, o.Empty(), "segment older than MaxAge is dropped")
+}
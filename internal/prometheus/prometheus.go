@@ -0,0 +1,117 @@
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"io"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	// ContentTypeText Текстовый формат экспозиции Prometheus
+	ContentTypeText = "text/plain; version=0.0.4; charset=utf-8"
+	// ContentTypeOpenMetrics Формат экспозиции OpenMetrics
+	ContentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Negotiate Выбирает формат экспозиции по заголовку Accept
+func Negotiate(accept string) string {
+	if strings.Contains(accept, "application/openmetrics-text") {
+		return ContentTypeOpenMetrics
+	}
+	return ContentTypeText
+}
+
+// SanitizeName Приводит имя метрики к виду [a-zA-Z_:][a-zA-Z0-9_:]*, заменяя недопустимые символы на _
+func SanitizeName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// Write Выводит метрики в формате экспозиции contentType: counter как counter, gauge как gauge,
+// с HELP и TYPE один раз на семейство и отдельной строкой на каждый набор меток.
+// Метрики, чьи имена совпали после очистки, выводятся один раз
+func Write(w io.Writer, metrics []storage.Metric, contentType string) error {
+	openMetrics := contentType == ContentTypeOpenMetrics
+	bw := bufio.NewWriter(w)
+
+	sorted := append([]storage.Metric(nil), metrics...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ID != sorted[j].ID {
+			return sorted[i].ID < sorted[j].ID
+		}
+		if sorted[i].MType != sorted[j].MType {
+			return sorted[i].MType < sorted[j].MType
+		}
+		return sorted[i].Labels.String() < sorted[j].Labels.String()
+	})
+
+	// families Какая метрика (тип и исходное имя) заняла имя семейства
+	families := make(map[string]storage.Metric, len(sorted))
+	for _, m := range sorted {
+		name := SanitizeName(m.ID)
+		sample := name
+		if m.MType == "counter" && openMetrics {
+			// В OpenMetrics значение counter публикуется с суффиксом _total
+			name = strings.TrimSuffix(name, "_total")
+			sample = name + "_total"
+		}
+		if owner, ok := families[name]; ok {
+			if owner.ID != m.ID || owner.MType != m.MType {
+				log.Printf("metric %s of type %s is skipped in exposition: name %s is already used", m.ID, m.MType, name)
+				continue
+			}
+		} else {
+			families[name] = m
+			fmt.Fprintf(bw, "# HELP %s %s metric %s\n", name, m.MType, escapeHelp(m.ID))
+			fmt.Fprintf(bw, "# TYPE %s %s\n", name, m.MType)
+		}
+
+		fmt.Fprintf(bw, "%s%s %s\n", sample, formatLabels(m.Labels), m.Value)
+	}
+
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+
+	return bw.Flush()
+}
+
+// formatLabels Выводит метки в виде {k="v",...}, имена меток очищаются так же, как имена метрик
+func formatLabels(labels storage.Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, k := range labels.Keys() {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, strings.ReplaceAll(SanitizeName(k), ":", "_"), escapeLabelValue(labels[k])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,70 @@
+package prometheus
+
+import (
+	"bytes"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name  string
+		wants string
+	}{
+		{name: "HeapAlloc", wants: "HeapAlloc"},
+		{name: "CPUutilization1", wants: "CPUutilization1"},
+		{name: "1stMetric", wants: "_1stMetric"},
+		{name: "disk.used-bytes", wants: "disk_used_bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wants, SanitizeName(tt.name))
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	metrics := []storage.Metric{
+		{MType: "gauge", ID: "Alloc", Value: "1.5"},
+		{MType: "counter", ID: "PollCount", Value: "5"},
+	}
+
+	var text bytes.Buffer
+	require.NoError(t, Write(&text, metrics, ContentTypeText))
+	assert.Equal(t, `# HELP Alloc gauge metric Alloc
+# TYPE Alloc gauge
+Alloc 1.5
+# HELP PollCount counter metric PollCount
+# TYPE PollCount counter
+PollCount 5
+`, text.String())
+
+	var om bytes.Buffer
+	require.NoError(t, Write(&om, metrics, Negotiate("application/openmetrics-text; version=1.0.0")))
+	assert.Equal(t, `# HELP Alloc gauge metric Alloc
+# TYPE Alloc gauge
+Alloc 1.5
+# HELP PollCount counter metric PollCount
+# TYPE PollCount counter
+PollCount_total 5
+# EOF
+`, om.String())
+}
+
+func TestWrite_Labels(t *testing.T) {
+	metrics := []storage.Metric{
+		{MType: "gauge", ID: "Alloc", Labels: storage.Labels{"host": "b"}, Value: "2"},
+		{MType: "gauge", ID: "Alloc", Labels: storage.Labels{"host": "a", "dc": `eu"1`}, Value: "1"},
+	}
+
+	var text bytes.Buffer
+	require.NoError(t, Write(&text, metrics, ContentTypeText))
+	assert.Equal(t, `# HELP Alloc gauge metric Alloc
+# TYPE Alloc gauge
+Alloc{dc="eu\"1",host="a"} 1
+Alloc{host="b"} 2
+`, text.String())
+}
@@ -0,0 +1,140 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Policy Политика повторов: до MaxAttempts попыток с экспоненциальной задержкой от BaseDelay до MaxDelay
+// и полным джиттером, то есть случайной задержкой от нуля до очередной границы
+type Policy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Retryable Решает, стоит ли повторять запрос после ошибки, nil - IsRetryable
+	Retryable func(err error) bool
+}
+
+// DefaultPolicy Политика повторов по умолчанию
+var DefaultPolicy = Policy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// StatusError Ответ сервера с неуспешным кодом, RetryAfter - задержка из заголовка Retry-After
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code not equal 200: %d", e.StatusCode)
+}
+
+// NewStatusError Создаёт ошибку по ответу сервера, разбирая Retry-After в секундах или в виде даты
+func NewStatusError(res *http.Response) *StatusError {
+	e := &StatusError{StatusCode: res.StatusCode}
+
+	value := res.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	} else if date, errDate := http.ParseTime(value); errDate == nil {
+		if d := time.Until(date); d > 0 {
+			e.RetryAfter = d
+		}
+	}
+	return e
+}
+
+// IsRetryable Повторять стоит сетевые ошибки, обрыв ответа, 429 и ответы 5xx.
+// Ошибка HTTP-клиента *url.Error сама по себе сетевая, поэтому проверяется вложенная в неё причина:
+// ошибку проверки сертификата или неверную схему адреса повторять бесполезно
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// Do Выполняет f, повторяя её по политике, пока ошибка повторяема. Ожидание прерывается отменой ctx.
+// Если сервер просит подождать через Retry-After дольше MaxDelay, повторы прекращаются
+func (p Policy) Do(ctx context.Context, f func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if !retryable(err) {
+			return err
+		}
+		if attempt == attempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		delay := p.backoff(attempt)
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+			if p.MaxDelay > 0 && statusErr.RetryAfter > p.MaxDelay {
+				return fmt.Errorf("server asked to retry after %s: %w", statusErr.RetryAfter, err)
+			}
+			delay = statusErr.RetryAfter
+		}
+
+		log.Printf("attempt %d of %d failed: %s, retrying in %s", attempt, attempts, err, delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff Случайная задержка перед попыткой attempt+1: от нуля до min(MaxDelay, BaseDelay*2^(attempt-1))
+func (p Policy) backoff(attempt int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	ceiling := p.BaseDelay
+	for i := 1; i < attempt && ceiling <= math.MaxInt64/2 && (p.MaxDelay <= 0 || ceiling < p.MaxDelay); i++ {
+		ceiling *= 2
+	}
+	if p.MaxDelay > 0 && ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
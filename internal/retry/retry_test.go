@@ -0,0 +1,113 @@
+package retry
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		testName string
+		err      error
+		want     bool
+	}{
+		{testName: "Network error", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: true},
+		{testName: "Broken response", err: io.ErrUnexpectedEOF, want: true},
+		{testName: "HTTP client network error", err: &url.Error{Op: "Post", URL: "http://localhost", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, want: true},
+		{testName: "HTTP client timeout", err: &url.Error{Op: "Post", URL: "http://localhost", Err: context.DeadlineExceeded}, want: true},
+		{testName: "Certificate verification", err: &url.Error{Op: "Post", URL: "https://localhost", Err: x509.UnknownAuthorityError{}}, want: false},
+		{testName: "Unsupported scheme", err: &url.Error{Op: "Post", URL: "ftp://localhost", Err: errors.New("unsupported protocol scheme")}, want: false},
+		{testName: "Too many requests", err: &StatusError{StatusCode: http.StatusTooManyRequests}, want: true},
+		{testName: "Server error", err: &StatusError{StatusCode: http.StatusBadGateway}, want: true},
+		{testName: "Bad request", err: &StatusError{StatusCode: http.StatusBadRequest}, want: false},
+		{testName: "Canceled", err: context.Canceled, want: false},
+		{testName: "Other error", err: errors.New("can't convert body to json"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsRetryable(tt.err))
+		})
+	}
+}
+
+func TestNewStatusError(t *testing.T) {
+	res := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}
+	res.Header.Set("Retry-After", "3")
+	assert.Equal(t, 3*time.Second, NewStatusError(res).RetryAfter)
+
+	res.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.InDelta(t, time.Minute, NewStatusError(res).RetryAfter, float64(2*time.Second))
+
+	res.Header.Del("Retry-After")
+	assert.Zero(t, NewStatusError(res).RetryAfter)
+}
+
+func TestPolicy_Do(t *testing.T) {
+	p := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	unavailable := &StatusError{StatusCode: http.StatusServiceUnavailable}
+
+	calls := 0
+	err := p.Do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return unavailable
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = p.Do(context.Background(), func() error {
+		calls++
+		return unavailable
+	})
+	require.ErrorIs(t, err, unavailable)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = p.Do(context.Background(), func() error {
+		calls++
+		return &StatusError{StatusCode: http.StatusBadRequest}
+	})
+	require.Error(t, err)
+	assert.Equal(t, 1, calls, "client errors aren't retried")
+
+	calls = 0
+	err = p.Do(context.Background(), func() error {
+		calls++
+		return &StatusError{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute}
+	})
+	require.Error(t, err)
+	assert.Equal(t, 1, calls, "Retry-After longer than MaxDelay stops retries")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	err = Policy{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}.Do(ctx, func() error {
+		calls++
+		return unavailable
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 1, calls)
+}
+
+func TestPolicy_backoff(t *testing.T) {
+	p := Policy{BaseDelay: time.Second, MaxDelay: 4 * time.Second}
+	for attempt := 1; attempt < 100; attempt++ {
+		delay := p.backoff(attempt)
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.LessOrEqual(t, delay, 4*time.Second)
+	}
+	assert.LessOrEqual(t, p.backoff(1), time.Second)
+}
@@ -0,0 +1,68 @@
+package rpc
+
+import (
+	"fmt"
+	pb "github.com/CvitoyBamp/metricsexporter/internal/proto"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"strconv"
+)
+
+// TypeFromString Переводит тип метрики из строкового представления хранилища в protobuf
+func TypeFromString(metricType string) (pb.Metric_MType, error) {
+	switch metricType {
+	case "gauge":
+		return pb.Metric_GAUGE, nil
+	case "counter":
+		return pb.Metric_COUNTER, nil
+	default:
+		return pb.Metric_UNSPECIFIED, fmt.Errorf("don't know such type: %s", metricType)
+	}
+}
+
+// TypeToString Переводит тип метрики из protobuf в строковое представление хранилища
+func TypeToString(metricType pb.Metric_MType) (string, error) {
+	switch metricType {
+	case pb.Metric_GAUGE:
+		return "gauge", nil
+	case pb.Metric_COUNTER:
+		return "counter", nil
+	default:
+		return "", fmt.Errorf("incorrect metric type %s, gauge or counter is expected", metricType)
+	}
+}
+
+// FromStorage Преобразует метрику хранилища в protobuf
+func FromStorage(m storage.Metric) (*pb.Metric, error) {
+	metricType, err := TypeFromString(m.MType)
+	if err != nil {
+		return nil, err
+	}
+	metric := &pb.Metric{Id: m.ID, Type: metricType, Labels: m.Labels}
+	if metricType == pb.Metric_GAUGE {
+		metric.Value, err = strconv.ParseFloat(m.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse value to gauge type (float64), error: %s", err)
+		}
+	} else {
+		metric.Delta, err = strconv.ParseInt(m.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse value to counter type (int64), error: %s", err)
+		}
+	}
+	return metric, nil
+}
+
+// ToStorage Преобразует метрику protobuf в метрику хранилища
+func ToStorage(m *pb.Metric) (storage.Metric, error) {
+	metricType, err := TypeToString(m.GetType())
+	if err != nil {
+		return storage.Metric{}, err
+	}
+	metric := storage.Metric{MType: metricType, ID: m.GetId(), Labels: m.GetLabels()}
+	if m.GetType() == pb.Metric_GAUGE {
+		metric.Value = strconv.FormatFloat(m.GetValue(), 'f', -1, 64)
+	} else {
+		metric.Value = strconv.FormatInt(m.GetDelta(), 10)
+	}
+	return metric, nil
+}
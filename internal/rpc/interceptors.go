@@ -0,0 +1,128 @@
+package rpc
+
+import (
+	"context"
+	"github.com/CvitoyBamp/metricsexporter/internal/middlewares"
+	pb "github.com/CvitoyBamp/metricsexporter/internal/proto"
+	"github.com/CvitoyBamp/metricsexporter/internal/subnet"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	// HashMetadata Ключ метаданных с HMAC-SHA256 подписью сообщения, аналог заголовка HashSHA256
+	HashMetadata = strings.ToLower(middlewares.HashHeader)
+	// RealIPMetadata Ключ метаданных с адресом агента, аналог заголовка X-Real-IP
+	RealIPMetadata = strings.ToLower(subnet.Header)
+)
+
+// writeMethods Методы, изменяющие метрики: для них обязательны подпись и проверка доверенной подсети
+var writeMethods = map[string]bool{
+	pb.Metrics_UpdateMetrics_FullMethodName: true,
+}
+
+// SignMessage Подписывает сообщение ключом key. Подписывается детерминированная сериализация protobuf
+func SignMessage(msg proto.Message, key string) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	return middlewares.Sign(data, key), nil
+}
+
+func metadataValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// LoggingUnaryInterceptor Логирует метод, код ответа и длительность вызова, как middlewares.Logging
+func LoggingUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	startTime := time.Now()
+	resp, err := handler(ctx, req)
+	logCall(info.FullMethod, err, time.Since(startTime))
+	return resp, err
+}
+
+// LoggingStreamInterceptor Логирует потоковые вызовы
+func LoggingStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	startTime := time.Now()
+	err := handler(srv, ss)
+	logCall(info.FullMethod, err, time.Since(startTime))
+	return err
+}
+
+func logCall(method string, err error, duration time.Duration) {
+	logger, errLogger := zap.NewDevelopment()
+	if errLogger != nil {
+		panic(errLogger)
+	}
+	defer logger.Sync()
+
+	logger.Sugar().Infoln(
+		"method", method,
+		"status", status.Code(err),
+		"duration", duration,
+	)
+}
+
+// HashUnaryInterceptor Проверяет подпись запроса из метаданных hashsha256 и подписывает ответ тем же ключом.
+// Изменяющие вызовы без подписи или с неверной подписью отклоняются с кодом InvalidArgument. С пустым ключом проверка отключена
+func HashUnaryInterceptor(key string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if key == "" {
+			return handler(ctx, req)
+		}
+
+		sign := metadataValue(ctx, HashMetadata)
+		if msg, ok := req.(proto.Message); ok && (sign != "" || writeMethods[info.FullMethod]) {
+			data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			if !middlewares.Verify(data, key, sign) {
+				log.Printf("call %s has incorrect %s signature", info.FullMethod, HashMetadata)
+				return nil, status.Error(codes.InvalidArgument, "incorrect signature of request")
+			}
+		}
+
+		resp, err := handler(ctx, req)
+		if msg, ok := resp.(proto.Message); ok && err == nil {
+			respSign, errSign := SignMessage(msg, key)
+			if errSign == nil {
+				grpc.SetHeader(ctx, metadata.Pairs(HashMetadata, respSign))
+			}
+		}
+		return resp, err
+	}
+}
+
+// TrustedSubnetUnaryInterceptor Пропускает изменяющие вызовы только с адресом из метаданных x-real-ip в доверенной подсети,
+// остальные отклоняются с кодом PermissionDenied. Без подсети проверка отключена
+func TrustedSubnetUnaryInterceptor(trusted *net.IPNet) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if trusted == nil || !writeMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		realIP := metadataValue(ctx, RealIPMetadata)
+		if !subnet.Allowed(trusted, realIP) {
+			log.Printf("call %s from %q is outside of trusted subnet %s", info.FullMethod, realIP, trusted)
+			return nil, status.Error(codes.PermissionDenied, "forbidden")
+		}
+		return handler(ctx, req)
+	}
+}
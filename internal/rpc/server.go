@@ -0,0 +1,125 @@
+// Package rpc gRPC-сервис метрик: приём пачек, чтение и потоковая выдача метрик из того же хранилища, что и у HTTP
+package rpc
+
+import (
+	"context"
+	"errors"
+	pb "github.com/CvitoyBamp/metricsexporter/internal/proto"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"log"
+	"net"
+	"time"
+)
+
+// MetricsServer Реализация gRPC-сервиса Metrics поверх хранилища метрик
+type MetricsServer struct {
+	pb.UnimplementedMetricsServer
+	Storage storage.Repository
+	Agents  *storage.AgentRegistry
+}
+
+// Options Настройки gRPC-сервера: ключ подписи, доверенная подсеть и TLS, пустые значения отключают проверки
+type Options struct {
+	Key           string
+	TrustedSubnet *net.IPNet
+	Credentials   credentials.TransportCredentials
+}
+
+// CreateServer Создаёт gRPC-сервер с сервисом Metrics и перехватчиками логирования, подписи и доверенной подсети
+func CreateServer(repo storage.Repository, agents *storage.AgentRegistry, opts Options) *grpc.Server {
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			LoggingUnaryInterceptor,
+			TrustedSubnetUnaryInterceptor(opts.TrustedSubnet),
+			HashUnaryInterceptor(opts.Key),
+		),
+		grpc.ChainStreamInterceptor(
+			LoggingStreamInterceptor,
+		),
+	}
+	if opts.Credentials != nil {
+		serverOpts = append(serverOpts, grpc.Creds(opts.Credentials))
+	}
+
+	s := grpc.NewServer(serverOpts...)
+	pb.RegisterMetricsServer(s, &MetricsServer{Storage: repo, Agents: agents})
+	return s
+}
+
+func (s *MetricsServer) UpdateMetrics(ctx context.Context, req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	batch := make([]storage.Metric, 0, len(req.GetMetrics()))
+	for _, m := range req.GetMetrics() {
+		metric, err := ToStorage(m)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "metric %s: %s", m.GetId(), err)
+		}
+		batch = append(batch, metric)
+	}
+
+	if err := s.Storage.SetMetrics(ctx, batch); err != nil {
+		log.Println("can't add metrics to storage ", err)
+		return nil, storageError(err)
+	}
+
+	if s.Agents != nil {
+		address := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			address = p.Addr.String()
+		}
+		for _, m := range batch {
+			s.Agents.Seen(m.Labels[storage.InstanceLabel], address, time.Now())
+		}
+	}
+
+	return &pb.UpdateMetricsResponse{}, nil
+}
+
+// storageError Ошибка хранилища для клиента: метрики уже проверены при разборе запроса,
+// поэтому временную недоступность агент повторит, а остальное считается внутренней ошибкой сервера
+func storageError(err error) error {
+	if errors.Is(err, storage.ErrUnavailable) || errors.Is(err, context.DeadlineExceeded) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *MetricsServer) GetMetric(ctx context.Context, req *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
+	metricType, err := TypeToString(req.GetType())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	value, err := s.Storage.GetMetric(ctx, metricType, req.GetId(), req.GetLabels())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "no such metric in storage: %s", storage.SeriesKey(req.GetId(), req.GetLabels()))
+	}
+
+	metric, err := FromStorage(storage.Metric{MType: metricType, ID: req.GetId(), Labels: req.GetLabels(), Value: value})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.GetMetricResponse{Metric: metric}, nil
+}
+
+func (s *MetricsServer) ListMetrics(_ *pb.ListMetricsRequest, stream pb.Metrics_ListMetricsServer) error {
+	metrics, err := s.Storage.ListMetrics(stream.Context())
+	if err != nil {
+		return status.Errorf(codes.Internal, "can't list metrics: %s", err)
+	}
+
+	for _, m := range metrics {
+		metric, err := FromStorage(m)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err = stream.Send(metric); err != nil {
+			return err
+		}
+	}
+	return nil
+}
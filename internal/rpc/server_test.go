@@ -0,0 +1,131 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pb "github.com/CvitoyBamp/metricsexporter/internal/proto"
+	"github.com/CvitoyBamp/metricsexporter/internal/storage"
+	"github.com/CvitoyBamp/metricsexporter/internal/subnet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"net"
+	"testing"
+)
+
+const key = "secret"
+
+func startServer(t *testing.T, repo storage.Repository) pb.MetricsClient {
+	trusted, err := subnet.Parse("10.0.0.0/8")
+	require.NoError(t, err)
+
+	listener := bufconn.Listen(1024 * 1024)
+	s := CreateServer(repo, storage.CreateAgentRegistry(), Options{Key: key, TrustedSubnet: trusted})
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewMetricsClient(conn)
+}
+
+func TestMetricsServer(t *testing.T) {
+	repo := storage.CreateMemStorage()
+	client := startServer(t, repo)
+
+	req := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: pb.Metric_GAUGE, Value: 1.5},
+		{Id: "PollCount", Type: pb.Metric_COUNTER, Labels: map[string]string{"instance": "a"}, Delta: 3},
+	}}
+	sign, err := SignMessage(req, key)
+	require.NoError(t, err)
+
+	tests := []struct {
+		testName string
+		md       metadata.MD
+		code     codes.Code
+	}{
+		{testName: "Unsigned update", md: metadata.Pairs(RealIPMetadata, "10.0.0.1"), code: codes.InvalidArgument},
+		{testName: "Update outside trusted subnet", md: metadata.Pairs(RealIPMetadata, "192.168.0.1", HashMetadata, sign), code: codes.PermissionDenied},
+		{testName: "Signed update", md: metadata.Pairs(RealIPMetadata, "10.0.0.1", HashMetadata, sign), code: codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			var header metadata.MD
+			_, err := client.UpdateMetrics(metadata.NewOutgoingContext(context.Background(), tt.md), req, grpc.Header(&header))
+			assert.Equal(t, tt.code, status.Code(err))
+			if tt.code == codes.OK {
+				respSign, errSign := SignMessage(&pb.UpdateMetricsResponse{}, key)
+				require.NoError(t, errSign)
+				assert.Equal(t, []string{respSign}, header.Get(HashMetadata))
+			}
+		})
+	}
+
+	resp, err := client.GetMetric(context.Background(), &pb.GetMetricRequest{
+		Id: "PollCount", Type: pb.Metric_COUNTER, Labels: map[string]string{"instance": "a"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), resp.GetMetric().GetDelta())
+
+	_, err = client.GetMetric(context.Background(), &pb.GetMetricRequest{Id: "PollCount", Type: pb.Metric_COUNTER})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	stream, err := client.ListMetrics(context.Background(), &pb.ListMetricsRequest{})
+	require.NoError(t, err)
+	var ids []string
+	for {
+		m, errRecv := stream.Recv()
+		if errRecv == io.EOF {
+			break
+		}
+		require.NoError(t, errRecv)
+		ids = append(ids, m.GetId())
+	}
+	assert.ElementsMatch(t, []string{"Alloc", "PollCount"}, ids)
+}
+
+// failingStorage Хранилище, которое не принимает запись
+type failingStorage struct {
+	storage.Repository
+	err error
+}
+
+func (s failingStorage) SetMetrics(context.Context, []storage.Metric) error {
+	return s.err
+}
+
+func TestMetricsServer_UpdateErrors(t *testing.T) {
+	tests := []struct {
+		testName string
+		err      error
+		metric   *pb.Metric
+		code     codes.Code
+	}{
+		{testName: "Invalid metric", metric: &pb.Metric{Id: "Alloc"}, code: codes.InvalidArgument},
+		{testName: "Storage is unavailable", err: fmt.Errorf("%w: connection refused", storage.ErrUnavailable),
+			metric: &pb.Metric{Id: "Alloc", Type: pb.Metric_GAUGE, Value: 1}, code: codes.Unavailable},
+		{testName: "Storage failure", err: errors.New("disk is full"),
+			metric: &pb.Metric{Id: "Alloc", Type: pb.Metric_GAUGE, Value: 1}, code: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			s := &MetricsServer{Storage: failingStorage{err: tt.err}}
+			_, err := s.UpdateMetrics(context.Background(), &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{tt.metric}})
+			assert.Equal(t, tt.code, status.Code(err))
+		})
+	}
+}
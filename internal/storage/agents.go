@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// InstanceLabel Метка, которой агент помечает все свои метрики
+const InstanceLabel = "instance"
+
+// AgentInfo Сведения об агенте, присылавшем метрики
+type AgentInfo struct {
+	Instance  string
+	Address   string
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// AgentRegistry Реестр агентов, от которых сервер получал метрики с меткой instance.
+// Хранится в памяти и заполняется заново после перезапуска сервера
+type AgentRegistry struct {
+	sync.RWMutex
+	agents map[string]*AgentInfo
+}
+
+func CreateAgentRegistry() *AgentRegistry {
+	return &AgentRegistry{
+		agents: make(map[string]*AgentInfo),
+	}
+}
+
+// Seen Отмечает, что агент instance прислал метрики с адреса address в момент now
+func (r *AgentRegistry) Seen(instance, address string, now time.Time) {
+	if instance == "" {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	a, ok := r.agents[instance]
+	if !ok {
+		a = &AgentInfo{Instance: instance, FirstSeen: now}
+		r.agents[instance] = a
+	}
+	a.Address = address
+	a.LastSeen = now
+}
+
+// List Возвращает копию реестра, отсортированную по имени агента
+func (r *AgentRegistry) List() []AgentInfo {
+	r.RLock()
+	defer r.RUnlock()
+	agents := make([]AgentInfo, 0, len(r.agents))
+	for _, a := range r.agents {
+		agents = append(agents, *a)
+	}
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].Instance < agents[j].Instance
+	})
+	return agents
+}
@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestAgentRegistry_Seen(t *testing.T) {
+	r := CreateAgentRegistry()
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	r.Seen("host-b", "10.0.0.2:5000", first)
+	r.Seen("host-a", "10.0.0.1:5000", first)
+	r.Seen("host-a", "10.0.0.1:5001", first.Add(time.Minute))
+	r.Seen("", "10.0.0.3:5000", first)
+
+	agents := r.List()
+	require.Len(t, agents, 2)
+	assert.Equal(t, AgentInfo{
+		Instance:  "host-a",
+		Address:   "10.0.0.1:5001",
+		FirstSeen: first,
+		LastSeen:  first.Add(time.Minute),
+	}, agents[0])
+	assert.Equal(t, "host-b", agents[1].Instance)
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// DefaultHistorySize Количество последних значений, которое in-memory хранилище держит для каждой метрики
+const DefaultHistorySize = 3600
+
+// Sample Значение метрики в момент времени
+type Sample struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// Rollup Агрегат значений метрики за интервал, начинающийся с Timestamp
+type Rollup struct {
+	Timestamp time.Time
+	Min       float64
+	Max       float64
+	Sum       float64
+	Count     int64
+	Last      float64
+}
+
+// Aggregation Способ свести несколько значений метрики в одно
+type Aggregation string
+
+const (
+	AggLast Aggregation = "last"
+	AggMin  Aggregation = "min"
+	AggMax  Aggregation = "max"
+	AggAvg  Aggregation = "avg"
+)
+
+// ParseAggregation Разбирает агрегацию, по умолчанию используется последнее значение
+func ParseAggregation(agg string) (Aggregation, error) {
+	switch Aggregation(agg) {
+	case AggLast, AggMin, AggMax, AggAvg:
+		return Aggregation(agg), nil
+	case "":
+		return AggLast, nil
+	default:
+		return "", fmt.Errorf("unknown aggregation %s, last, min, max or avg is expected", agg)
+	}
+}
+
+// RangeQuery Параметры запроса истории метрики
+type RangeQuery struct {
+	MType  string
+	ID     string
+	Labels Labels
+	From   time.Time
+	To     time.Time
+	Step   time.Duration
+	Agg    Aggregation
+}
+
+func rollupOf(s Sample) Rollup {
+	return Rollup{
+		Timestamp: s.Timestamp,
+		Min:       s.Value,
+		Max:       s.Value,
+		Sum:       s.Value,
+		Count:     1,
+		Last:      s.Value,
+	}
+}
+
+// merge Добавляет к агрегату более поздний агрегат
+func (r *Rollup) merge(other Rollup) {
+	r.Min = math.Min(r.Min, other.Min)
+	r.Max = math.Max(r.Max, other.Max)
+	r.Sum += other.Sum
+	r.Count += other.Count
+	r.Last = other.Last
+}
+
+func (r Rollup) value(agg Aggregation) float64 {
+	switch agg {
+	case AggMin:
+		return r.Min
+	case AggMax:
+		return r.Max
+	case AggAvg:
+		return r.Sum / float64(r.Count)
+	default:
+		return r.Last
+	}
+}
+
+// ring Кольцевой буфер значений одной метрики
+type ring struct {
+	samples []Sample
+	next    int
+	full    bool
+}
+
+func newRing(size int) *ring {
+	return &ring{
+		samples: make([]Sample, size),
+	}
+}
+
+// add Добавляет значение и возвращает вытесненное из буфера, если он был заполнен
+func (r *ring) add(s Sample) (Sample, bool) {
+	evicted, wasFull := r.samples[r.next], r.full
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+	return evicted, wasFull
+}
+
+func (r *ring) ordered() []Sample {
+	var ordered []Sample
+	if r.full {
+		ordered = append(ordered, r.samples[r.next:]...)
+	}
+	return append(ordered, r.samples[:r.next]...)
+}
+
+// dropBefore Удаляет из буфера значения старше t и возвращает их
+func (r *ring) dropBefore(t time.Time) []Sample {
+	ordered := r.ordered()
+	i := 0
+	for i < len(ordered) && ordered[i].Timestamp.Before(t) {
+		i++
+	}
+	if i == 0 {
+		return nil
+	}
+
+	r.samples = make([]Sample, len(r.samples))
+	r.next, r.full = 0, false
+	for _, s := range ordered[i:] {
+		r.add(s)
+	}
+	return ordered[:i]
+}
+
+// between Возвращает значения из интервала [from, to] в хронологическом порядке
+func (r *ring) between(from, to time.Time) []Sample {
+	ordered := r.ordered()
+	res := make([]Sample, 0, len(ordered))
+	for _, s := range ordered {
+		if s.Timestamp.Before(from) || s.Timestamp.After(to) {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// ApplyStep Разбивает интервал на отрезки длиной Step, начиная с From, и сводит агрегаты каждого
+// отрезка в одно значение с меткой времени начала отрезка. При Step <= 0 отрезками служат сами агрегаты
+func ApplyStep(rollups []Rollup, q RangeQuery) []Sample {
+	merged := make([]Rollup, 0, len(rollups))
+	for _, r := range rollups {
+		if q.Step > 0 {
+			r.Timestamp = q.From.Add(r.Timestamp.Sub(q.From) / q.Step * q.Step)
+		}
+		if q.Step > 0 && len(merged) > 0 && merged[len(merged)-1].Timestamp.Equal(r.Timestamp) {
+			merged[len(merged)-1].merge(r)
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	res := make([]Sample, 0, len(merged))
+	for _, r := range merged {
+		res = append(res, Sample{Timestamp: r.Timestamp, Value: r.value(q.Agg)})
+	}
+	return res
+}
+
+func historyKey(metricType, seriesKey string) string {
+	return metricType + ":" + seriesKey
+}
@@ -1,33 +1,65 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"sync"
+	"time"
 )
 
-// MemStorage In-memory хранилище метрик
+// MemStorage In-memory хранилище метрик. Значения хранятся по ключу ряда: имени и отсортированным меткам
 type MemStorage struct {
 	sync.RWMutex
-	gauge   map[string]float64
-	counter map[string]int64
+	gauge       map[string]float64
+	counter     map[string]int64
+	labels      map[string]seriesID
+	history     map[string]*series
+	historySize int
+}
+
+// seriesID Имя и метки, из которых получен ключ ряда
+type seriesID struct {
+	name   string
+	labels Labels
+}
+
+// series История одной метрики: сырые значения и свёрнутые агрегаты
+type series struct {
+	raw    *ring
+	minute []Rollup
+	hourly []Rollup
 }
 
 func CreateMemStorage() *MemStorage {
+	return CreateMemStorageWithHistory(DefaultHistorySize)
+}
+
+// CreateMemStorageWithHistory Создаёт хранилище, которое держит historySize последних значений каждой метрики
+func CreateMemStorageWithHistory(historySize int) *MemStorage {
+	if historySize <= 0 {
+		historySize = DefaultHistorySize
+	}
 	return &MemStorage{
-		gauge:   make(map[string]float64),
-		counter: make(map[string]int64),
+		gauge:       make(map[string]float64),
+		counter:     make(map[string]int64),
+		labels:      make(map[string]seriesID),
+		history:     make(map[string]*series),
+		historySize: historySize,
 	}
 }
 
-func (ms *MemStorage) SetMetric(metricType, metricName, metricValue string) error {
+func (ms *MemStorage) SetMetric(_ context.Context, metricType, metricName string, labels Labels, metricValue string) error {
+	key := SeriesKey(metricName, labels)
 	if metricType == "counter" {
 		value, err := strconv.ParseInt(metricValue, 10, 64)
 		if err != nil {
 			return fmt.Errorf("can't parse value to counter type (int64), error: %s", err)
 		}
 		ms.Lock()
-		ms.counter[metricName] += value
+		ms.counter[key] += value
+		ms.remember(key, metricName, labels)
+		ms.addSample(metricType, key, float64(ms.counter[key]))
 		ms.Unlock()
 	} else if metricType == "gauge" {
 		value, err := strconv.ParseFloat(metricValue, 64)
@@ -35,7 +67,9 @@ func (ms *MemStorage) SetMetric(metricType, metricName, metricValue string) erro
 			return fmt.Errorf("can't parse value to gauge type (float64), error: %s", err)
 		}
 		ms.Lock()
-		ms.gauge[metricName] = value
+		ms.gauge[key] = value
+		ms.remember(key, metricName, labels)
+		ms.addSample(metricType, key, value)
 		ms.Unlock()
 	} else {
 		return fmt.Errorf("don't know such type: %s", metricType)
@@ -44,36 +78,59 @@ func (ms *MemStorage) SetMetric(metricType, metricName, metricValue string) erro
 	return nil
 }
 
-func (ms *MemStorage) GetMetric(metricType, metricName string) (string, error) {
+// remember Запоминает имя и метки ряда, вызывается под блокировкой
+func (ms *MemStorage) remember(key, metricName string, labels Labels) {
+	if _, ok := ms.labels[key]; ok {
+		return
+	}
+	var copied Labels
+	if len(labels) > 0 {
+		copied = make(Labels, len(labels))
+		for k, v := range labels {
+			copied[k] = v
+		}
+	}
+	ms.labels[key] = seriesID{name: metricName, labels: copied}
+}
+
+func (ms *MemStorage) SetMetrics(ctx context.Context, metrics []Metric) error {
+	for _, m := range metrics {
+		if err := ms.SetMetric(ctx, m.MType, m.ID, m.Labels, m.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ms *MemStorage) GetMetric(_ context.Context, metricType, metricName string, labels Labels) (string, error) {
+	key := SeriesKey(metricName, labels)
+	ms.RLock()
+	defer ms.RUnlock()
 	if metricType == "counter" {
-		ms.RLock()
-		defer ms.RUnlock()
-		_, ok := ms.counter[metricName]
+		val, ok := ms.counter[key]
 		if ok {
-			val := ms.counter[metricName]
 			return fmt.Sprintf("%d", val), nil
 		} else {
-			return "", fmt.Errorf("don't have metric %s of type %s in storage", metricName, metricType)
+			return "", fmt.Errorf("don't have metric %s of type %s in storage", key, metricType)
 		}
 	} else if metricType == "gauge" {
-		_, ok := ms.gauge[metricName]
+		val, ok := ms.gauge[key]
 		if ok {
-			val := ms.gauge[metricName]
 			return strconv.FormatFloat(val, 'f', -1, 64), nil
 		} else {
-			return "", fmt.Errorf("don't have metric %s of type %s in storage", metricName, metricType)
+			return "", fmt.Errorf("don't have metric %s of type %s in storage", key, metricType)
 		}
 	} else {
 		return "", fmt.Errorf("don't have metric's type %s in storage", metricType)
 	}
 }
 
-func (ms *MemStorage) GetExistsMetrics() (map[string]string, error) {
+func (ms *MemStorage) GetExistsMetrics(_ context.Context) (map[string]string, error) {
+	ms.RLock()
+	defer ms.RUnlock()
 	l := len(ms.gauge) + len(ms.counter)
 	if l != 0 {
 		metricsList := make(map[string]string, l)
-		ms.Lock()
-		defer ms.Unlock()
 		for k, v := range ms.gauge {
 			metricsList[k] = fmt.Sprintf("%f", v)
 		}
@@ -86,6 +143,28 @@ func (ms *MemStorage) GetExistsMetrics() (map[string]string, error) {
 	}
 }
 
+func (ms *MemStorage) ListMetrics(_ context.Context) ([]Metric, error) {
+	return ms.Snapshot(), nil
+}
+
+// Snapshot Возвращает копию всех метрик хранилища
+func (ms *MemStorage) Snapshot() []Metric {
+	ms.RLock()
+	defer ms.RUnlock()
+	metrics := make([]Metric, 0, len(ms.gauge)+len(ms.counter))
+	for k, v := range ms.gauge {
+		id := ms.labels[k]
+		metrics = append(metrics, Metric{MType: "gauge", ID: id.name, Labels: id.labels,
+			Value: strconv.FormatFloat(v, 'f', -1, 64)})
+	}
+	for k, v := range ms.counter {
+		id := ms.labels[k]
+		metrics = append(metrics, Metric{MType: "counter", ID: id.name, Labels: id.labels,
+			Value: strconv.FormatInt(v, 10)})
+	}
+	return metrics
+}
+
 func (ms *MemStorage) GetGaugeMetrics() map[string]float64 {
 	return ms.gauge
 }
@@ -94,13 +173,88 @@ func (ms *MemStorage) GetCounterMetrics() map[string]int64 {
 	return ms.counter
 }
 
-func (ms *MemStorage) DeleteMetric(metricType, metricName string) error {
+func (ms *MemStorage) DeleteMetric(_ context.Context, metricType, metricName string, labels Labels) error {
+	key := SeriesKey(metricName, labels)
+	ms.Lock()
+	defer ms.Unlock()
 	if metricType == "counter" {
-		delete(ms.counter, metricName)
+		delete(ms.counter, key)
 	} else if metricType == "gauge" {
-		delete(ms.gauge, metricName)
+		delete(ms.gauge, key)
 	} else {
-		_ = fmt.Errorf("don't have such metric %s of type %s", metricName, metricType)
+		return fmt.Errorf("don't have such metric %s of type %s", key, metricType)
+	}
+	delete(ms.history, historyKey(metricType, key))
+	_, hasGauge := ms.gauge[key]
+	_, hasCounter := ms.counter[key]
+	if !hasGauge && !hasCounter {
+		delete(ms.labels, key)
+	}
+	return nil
+}
+
+// addSample Записывает значение в историю метрики, вызывается под блокировкой.
+// Значение, вытесненное из переполненного буфера, сворачивается в минутный агрегат, а не теряется
+func (ms *MemStorage) addSample(metricType, key string, value float64) {
+	key = historyKey(metricType, key)
+	h, ok := ms.history[key]
+	if !ok {
+		h = &series{raw: newRing(ms.historySize)}
+		ms.history[key] = h
+	}
+	if evicted, ok := h.raw.add(Sample{Timestamp: time.Now(), Value: value}); ok {
+		h.minute = appendRollup(h.minute, rollupOf(evicted), time.Minute)
+	}
+}
+
+func (ms *MemStorage) GetRange(_ context.Context, q RangeQuery) ([]Sample, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	h, ok := ms.history[historyKey(q.MType, SeriesKey(q.ID, q.Labels))]
+	if !ok {
+		return nil, fmt.Errorf("don't have metric %s of type %s in storage", SeriesKey(q.ID, q.Labels), q.MType)
+	}
+
+	rollups := rollupsBetween(h.hourly, q.From, q.To)
+	rollups = append(rollups, rollupsBetween(h.minute, q.From, q.To)...)
+	for _, s := range h.raw.between(q.From, q.To) {
+		rollups = append(rollups, rollupOf(s))
+	}
+
+	return ApplyStep(rollups, q), nil
+}
+
+// Compact Сворачивает устаревшие сырые значения в минутные агрегаты, минутные - в часовые
+// и удаляет часовые агрегаты старше политики хранения
+func (ms *MemStorage) Compact(_ context.Context, policy RetentionPolicy, now time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, h := range ms.history {
+		for _, s := range h.raw.dropBefore(now.Add(-policy.Raw)) {
+			h.minute = appendRollup(h.minute, rollupOf(s), time.Minute)
+		}
+
+		old, rest := splitBefore(h.minute, now.Add(-policy.Minute))
+		for _, r := range old {
+			h.hourly = appendRollup(h.hourly, r, time.Hour)
+		}
+		h.minute = append([]Rollup(nil), rest...)
+
+		if policy.Hourly > 0 {
+			_, rest = splitBefore(h.hourly, now.Add(-policy.Hourly))
+			h.hourly = append([]Rollup(nil), rest...)
+		}
 	}
+
+	return nil
+}
+
+// Ping In-memory хранилище всегда доступно
+func (ms *MemStorage) Ping(_ context.Context) error {
+	return nil
+}
+
+func (ms *MemStorage) Close() error {
 	return nil
 }
@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 type metric struct {
@@ -54,12 +56,12 @@ func TestMemStorage_SetMetric(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.testName, func(t *testing.T) {
 			if tt.dataMetric.metricType == "gauge" {
-				err := tt.ms.SetMetric(tt.dataMetric.metricType, tt.dataMetric.metricName, tt.dataMetric.metricStrValue)
+				err := tt.ms.SetMetric(context.Background(), tt.dataMetric.metricType, tt.dataMetric.metricName, nil, tt.dataMetric.metricStrValue)
 				require.NoError(t, err)
 				//tt.ms.gauge[tt.wants.metricName] = tt.wants.metricGaugeValue
 				assert.Equal(t, tt.wants.metricGaugeValue, tt.ms.gauge[tt.dataMetric.metricName])
 			} else if tt.dataMetric.metricType == "counter" {
-				err := tt.ms.SetMetric(tt.dataMetric.metricType, tt.dataMetric.metricName, tt.dataMetric.metricStrValue)
+				err := tt.ms.SetMetric(context.Background(), tt.dataMetric.metricType, tt.dataMetric.metricName, nil, tt.dataMetric.metricStrValue)
 				require.NoError(t, err)
 				//tt.ms.counter[tt.wants.metricName] = tt.wants.metricCounterValue
 				assert.Equal(t, tt.wants.metricCounterValue, tt.ms.counter[tt.wants.metricName])
@@ -109,13 +111,103 @@ func TestMemStorage_GetMetric(t *testing.T) {
 		t.Run(tt.testName, func(t *testing.T) {
 			if tt.dataMetric.metricType == "gauge" {
 				tt.ms.gauge[tt.dataMetric.metricName] = tt.dataMetric.metricGaugeValue
-				val, _ := tt.ms.GetMetric(tt.dataMetric.metricType, tt.dataMetric.metricName)
+				val, _ := tt.ms.GetMetric(context.Background(), tt.dataMetric.metricType, tt.dataMetric.metricName, nil)
 				assert.Equal(t, tt.wants.metricStrValue, val)
 			} else if tt.dataMetric.metricType == "counter" {
 				tt.ms.counter[tt.dataMetric.metricName] = tt.dataMetric.metricCounterValue
-				val, _ := tt.ms.GetMetric(tt.dataMetric.metricType, tt.dataMetric.metricName)
+				val, _ := tt.ms.GetMetric(context.Background(), tt.dataMetric.metricType, tt.dataMetric.metricName, nil)
 				assert.Equal(t, tt.wants.metricStrValue, val)
 			}
 		})
 	}
 }
+
+func TestMemStorage_Labels(t *testing.T) {
+	ms := CreateMemStorage()
+	ctx := context.Background()
+
+	require.NoError(t, ms.SetMetric(ctx, "counter", "requests", Labels{"host": "a"}, "1"))
+	require.NoError(t, ms.SetMetric(ctx, "counter", "requests", Labels{"host": "b"}, "5"))
+	require.NoError(t, ms.SetMetric(ctx, "counter", "requests", Labels{"host": "a"}, "2"))
+
+	val, err := ms.GetMetric(ctx, "counter", "requests", Labels{"host": "a"})
+	require.NoError(t, err)
+	assert.Equal(t, "3", val)
+
+	val, err = ms.GetMetric(ctx, "counter", "requests", Labels{"host": "b"})
+	require.NoError(t, err)
+	assert.Equal(t, "5", val)
+
+	_, err = ms.GetMetric(ctx, "counter", "requests", nil)
+	assert.Error(t, err)
+
+	metrics, err := ms.ListMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+
+	require.NoError(t, ms.DeleteMetric(ctx, "counter", "requests", Labels{"host": "a"}))
+	metrics, err = ms.ListMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Metric{{MType: "counter", ID: "requests", Labels: Labels{"host": "b"}, Value: "5"}}, metrics)
+}
+
+func TestMemStorage_GetRange(t *testing.T) {
+	ms := CreateMemStorageWithHistory(3)
+	from := time.Now().Add(-time.Minute)
+
+	for _, v := range []string{"1", "2", "3", "4"} {
+		require.NoError(t, ms.SetMetric(context.Background(), "counter", "testCounter", nil, v))
+	}
+
+	q := RangeQuery{MType: "counter", ID: "testCounter", From: from, To: time.Now(), Agg: AggLast}
+
+	samples, err := ms.GetRange(context.Background(), q)
+	require.NoError(t, err)
+	require.Len(t, samples, 4, "evicted sample is kept as a minute rollup")
+	assert.Equal(t, []float64{1, 3, 6, 10}, []float64{samples[0].Value, samples[1].Value, samples[2].Value, samples[3].Value})
+
+	q.Step = time.Hour
+	stepped, err := ms.GetRange(context.Background(), q)
+	require.NoError(t, err)
+	require.Len(t, stepped, 1)
+	assert.Equal(t, 10.0, stepped[0].Value)
+	assert.Equal(t, from, stepped[0].Timestamp)
+
+	q.Agg = AggAvg
+	stepped, err = ms.GetRange(context.Background(), q)
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, stepped[0].Value)
+
+	_, err = ms.GetRange(context.Background(), RangeQuery{MType: "gauge", ID: "unknown", From: from, To: time.Now()})
+	assert.Error(t, err)
+}
+
+func TestMemStorage_Compact(t *testing.T) {
+	ms := CreateMemStorage()
+	for _, v := range []string{"1", "5", "3"} {
+		require.NoError(t, ms.SetMetric(context.Background(), "gauge", "testGauge", nil, v))
+	}
+
+	policy := RetentionPolicy{Raw: time.Hour, Minute: 24 * time.Hour}
+	require.NoError(t, policy.Validate())
+
+	// Через два часа сырые значения сворачиваются в один минутный агрегат
+	now := time.Now().Add(2 * time.Hour)
+	require.NoError(t, ms.Compact(context.Background(), policy, now))
+
+	h := ms.history[historyKey("gauge", "testGauge")]
+	assert.Empty(t, h.raw.ordered())
+	require.Len(t, h.minute, 1)
+	assert.Equal(t, Rollup{Timestamp: h.minute[0].Timestamp, Min: 1, Max: 5, Sum: 9, Count: 3, Last: 3}, h.minute[0])
+
+	// Через двое суток минутный агрегат переносится в часовой
+	require.NoError(t, ms.Compact(context.Background(), policy, now.Add(48*time.Hour)))
+	assert.Empty(t, h.minute)
+	require.Len(t, h.hourly, 1)
+	assert.Equal(t, int64(3), h.hourly[0].Count)
+
+	// Часовые агрегаты старше политики хранения удаляются
+	policy.Hourly = 72 * time.Hour
+	require.NoError(t, ms.Compact(context.Background(), policy, now.Add(96*time.Hour)))
+	assert.Empty(t, h.hourly)
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LabelQueryPrefix Префикс параметров URL, в которых передаются метки: ?label.host=a&label.env=prod
+const LabelQueryPrefix = "label."
+
+// Labels Метки метрики. Метрика однозначно определяется именем и набором меток
+type Labels map[string]string
+
+// Keys Возвращает имена меток в отсортированном порядке
+func (l Labels) Keys() []string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// String Возвращает метки в виде {k1="v1",k2="v2"} с сортировкой по имени, для пустых меток - пустую строку
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range l.Keys() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// JSON Возвращает метки в виде JSON-объекта, пустые метки - {}
+func (l Labels) JSON() string {
+	if len(l) == 0 {
+		return "{}"
+	}
+	data, _ := json.Marshal(map[string]string(l))
+	return string(data)
+}
+
+// Equal Сравнивает наборы меток
+func (l Labels) Equal(other Labels) bool {
+	if len(l) != len(other) {
+		return false
+	}
+	for k, v := range l {
+		if ov, ok := other[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SeriesKey Ключ ряда метрики: имя и отсортированные метки. Для метрики без меток совпадает с именем
+func SeriesKey(metricName string, labels Labels) string {
+	return metricName + labels.String()
+}
+
+// ParseLabels Извлекает метки из параметров URL вида label.<имя>=<значение>
+func ParseLabels(query url.Values) Labels {
+	var labels Labels
+	for k, v := range query {
+		name := strings.TrimPrefix(k, LabelQueryPrefix)
+		if name == k || name == "" || len(v) == 0 {
+			continue
+		}
+		if labels == nil {
+			labels = make(Labels)
+		}
+		labels[name] = v[len(v)-1]
+	}
+	return labels
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy Политика хранения истории: сырые значения хранятся Raw, затем сворачиваются
+// в минутные агрегаты, которые хранятся Minute, затем в часовые, которые хранятся Hourly (0 - бессрочно)
+type RetentionPolicy struct {
+	Raw    time.Duration `json:"raw"`
+	Minute time.Duration `json:"minute"`
+	Hourly time.Duration `json:"hourly"`
+}
+
+func (p RetentionPolicy) Validate() error {
+	if p.Raw <= 0 || p.Minute <= 0 || p.Hourly < 0 {
+		return fmt.Errorf("retention of raw samples and minute rollups must be positive, hourly rollups can't be negative")
+	}
+	if p.Minute < p.Raw {
+		return fmt.Errorf("minute rollups retention (%s) must be longer than raw samples retention (%s)", p.Minute, p.Raw)
+	}
+	if p.Hourly != 0 && p.Hourly < p.Minute {
+		return fmt.Errorf("hourly rollups retention (%s) must be longer than minute rollups retention (%s)", p.Hourly, p.Minute)
+	}
+	return nil
+}
+
+// Compactor Фоновая задача, сворачивающая историю метрик хранилища по политике хранения
+type Compactor struct {
+	sync.RWMutex
+	Repo     Repository
+	Policy   RetentionPolicy
+	Interval time.Duration
+	lastRun  time.Time
+	lastErr  error
+}
+
+func CreateCompactor(repo Repository, policy RetentionPolicy, interval time.Duration) *Compactor {
+	return &Compactor{
+		Repo:     repo,
+		Policy:   policy,
+		Interval: interval,
+	}
+}
+
+// Run Запускает сворачивание истории раз в Interval до отмены контекста
+func (c *Compactor) Run(ctx context.Context) {
+	cI := time.NewTicker(c.Interval)
+	defer cI.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-cI.C:
+			if err := c.Compact(ctx); err != nil {
+				log.Printf("can't compact metrics history, err: %s", err)
+			}
+		}
+	}
+}
+
+func (c *Compactor) Compact(ctx context.Context) error {
+	now := time.Now()
+	err := c.Repo.Compact(ctx, c.Policy, now)
+
+	c.Lock()
+	c.lastRun, c.lastErr = now, err
+	c.Unlock()
+
+	return err
+}
+
+// Status Возвращает время последнего сворачивания и его ошибку
+func (c *Compactor) Status() (time.Time, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.lastRun, c.lastErr
+}
+
+// appendRollup Добавляет агрегат к хронологически упорядоченному списку, объединяя агрегаты одного интервала
+func appendRollup(rollups []Rollup, r Rollup, resolution time.Duration) []Rollup {
+	r.Timestamp = r.Timestamp.Truncate(resolution)
+	if len(rollups) > 0 && rollups[len(rollups)-1].Timestamp.Equal(r.Timestamp) {
+		rollups[len(rollups)-1].merge(r)
+		return rollups
+	}
+	return append(rollups, r)
+}
+
+// splitBefore Делит хронологически упорядоченный список агрегатов по моменту t
+func splitBefore(rollups []Rollup, t time.Time) ([]Rollup, []Rollup) {
+	i := 0
+	for i < len(rollups) && rollups[i].Timestamp.Before(t) {
+		i++
+	}
+	return rollups[:i], rollups[i:]
+}
+
+func rollupsBetween(rollups []Rollup, from, to time.Time) []Rollup {
+	res := make([]Rollup, 0, len(rollups))
+	for _, r := range rollups {
+		if r.Timestamp.Before(from) || r.Timestamp.After(to) {
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
@@ -1,11 +1,61 @@
 package storage
 
-// IMemStorage Интрфейс с абстрактным функциями добавления, просмотра и удаления метрик в хранилище
-type IMemStorage interface {
-	SetMetric(metricType, metricName, metricValue string) error
-	GetMetric(metricType, metricName string) (string, error)
-	GetExistsMetrics() (map[string]string, error)
-	DeleteMetric(metricType, metricName string) error
-	GetGaugeMetrics() map[string]float64
-	GetCounterMetrics() map[string]int64
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Metric Метрика в строковом представлении, используется для пакетной записи
+type Metric struct {
+	MType  string
+	ID     string
+	Labels Labels
+	Value  string
+}
+
+// ErrUnavailable Хранилище временно недоступно, например потеряно соединение с БД: запрос можно повторить позже
+var ErrUnavailable = errors.New("storage is unavailable")
+
+// Repository Интерфейс хранилища метрик, реализуется in-memory, файловым и Postgres хранилищами
+type Repository interface {
+	SetMetric(ctx context.Context, metricType, metricName string, labels Labels, metricValue string) error
+	SetMetrics(ctx context.Context, metrics []Metric) error
+	GetMetric(ctx context.Context, metricType, metricName string, labels Labels) (string, error)
+	GetExistsMetrics(ctx context.Context) (map[string]string, error)
+	ListMetrics(ctx context.Context) ([]Metric, error)
+	DeleteMetric(ctx context.Context, metricType, metricName string, labels Labels) error
+	GetRange(ctx context.Context, q RangeQuery) ([]Sample, error)
+	Compact(ctx context.Context, policy RetentionPolicy, now time.Time) error
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// RestorePolicy Политика восстановления метрик при старте сервера
+type RestorePolicy string
+
+const (
+	// RestoreKeep Оставить уже сохранённые метрики (для файла - загрузить его содержимое)
+	RestoreKeep RestorePolicy = "keep"
+	// RestoreReset Начать с пустого хранилища
+	RestoreReset RestorePolicy = "reset"
+	// RestoreFile Заменить содержимое хранилища снимком метрик из файла
+	RestoreFile RestorePolicy = "file"
+)
+
+// ParseRestorePolicy Разбирает политику восстановления; если она не задана, выбирает её по флагу restore.
+// БД без явной политики не очищается: флаг restore относится только к файлу
+func ParseRestorePolicy(policy string, restore, database bool) (RestorePolicy, error) {
+	switch RestorePolicy(policy) {
+	case RestoreKeep, RestoreReset, RestoreFile:
+		return RestorePolicy(policy), nil
+	case "":
+		if restore || database {
+			return RestoreKeep, nil
+		}
+		return RestoreReset, nil
+	default:
+		return "", fmt.Errorf("unknown restore policy %s, keep, reset or file is expected", policy)
+	}
 }
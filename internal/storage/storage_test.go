@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRestorePolicy(t *testing.T) {
+	tests := []struct {
+		testName string
+		policy   string
+		restore  bool
+		database bool
+		wants    RestorePolicy
+		wantsErr bool
+	}{
+		{testName: "Explicit policy wins over restore flag", policy: "file", restore: false, wants: RestoreFile},
+		{testName: "Restore flag means keep", policy: "", restore: true, wants: RestoreKeep},
+		{testName: "No restore flag means reset", policy: "", restore: false, wants: RestoreReset},
+		{testName: "Database is kept without explicit policy", policy: "", restore: false, database: true, wants: RestoreKeep},
+		{testName: "Database is reset only by explicit policy", policy: "reset", restore: true, database: true, wants: RestoreReset},
+		{testName: "Unknown policy", policy: "wipe", restore: true, wantsErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			policy, err := ParseRestorePolicy(tt.policy, tt.restore, tt.database)
+			if tt.wantsErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wants, policy)
+		})
+	}
+}
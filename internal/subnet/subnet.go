@@ -0,0 +1,42 @@
+// Package subnet Ограничение приёма метрик доверенной подсетью по адресу агента из заголовка X-Real-IP
+package subnet
+
+import (
+	"fmt"
+	"net"
+)
+
+// Header Заголовок, в котором агент передаёт адрес своего исходящего интерфейса
+const Header = "X-Real-IP"
+
+// Parse Разбирает подсеть в нотации CIDR, пустая строка означает, что ограничение не задано
+func Parse(cidr string) (*net.IPNet, error) {
+	if cidr == "" {
+		return nil, nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse trusted subnet %s: %w", cidr, err)
+	}
+	return ipNet, nil
+}
+
+// Allowed Проверяет, что адрес realIP входит в доверенную подсеть. Без подсети разрешены все адреса
+func Allowed(trusted *net.IPNet, realIP string) bool {
+	if trusted == nil {
+		return true
+	}
+	ip := net.ParseIP(realIP)
+	return ip != nil && trusted.Contains(ip)
+}
+
+// OutboundIP Возвращает адрес интерфейса, через который уходят пакеты к address (host:port).
+// UDP-сокет только выбирает маршрут, пакеты при этом не отправляются
+func OutboundIP(address string) (string, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return "", fmt.Errorf("can't find outbound address for %s: %w", address, err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
@@ -0,0 +1,38 @@
+package subnet
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	trusted, err := Parse("192.168.1.0/24")
+	require.NoError(t, err)
+
+	tests := []struct {
+		realIP string
+		wants  bool
+	}{
+		{realIP: "192.168.1.10", wants: true},
+		{realIP: "192.168.2.10", wants: false},
+		{realIP: "", wants: false},
+		{realIP: "not-an-ip", wants: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.realIP, func(t *testing.T) {
+			assert.Equal(t, tt.wants, Allowed(trusted, tt.realIP))
+		})
+	}
+
+	assert.True(t, Allowed(nil, ""))
+
+	_, err = Parse("192.168.1.0")
+	assert.Error(t, err)
+}
+
+func TestOutboundIP(t *testing.T) {
+	ip, err := OutboundIP("127.0.0.1:8080")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", ip)
+}
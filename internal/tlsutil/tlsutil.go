@@ -0,0 +1,76 @@
+// Package tlsutil Сборка TLS-конфигураций сервера и агента из файлов сертификатов
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// ServerConfig Конфигурация TLS сервера. Если задан clientCA, сервер требует клиентский сертификат,
+// подписанный этим CA (mTLS)
+func ServerConfig(clientCA string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if clientCA == "" {
+		return cfg, nil
+	}
+
+	pool, err := loadCertPool(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
+
+// ClientConfig Конфигурация TLS агента: caFile дополняет системные корневые сертификаты,
+// certFile и keyFile задают клиентский сертификат для mTLS. Пустые пути не используются
+func ClientConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if err = appendCerts(pool, caFile); err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if err := appendCerts(pool, path); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func appendCerts(pool *x509.CertPool, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("can't read CA bundle: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates in CA bundle %s", path)
+	}
+	return nil
+}